@@ -0,0 +1,412 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/pflow-dev/go-metamodel/v2/codec"
+	"github.com/pflow-dev/go-metamodel/v2/metamodel"
+	"github.com/pflow-dev/go-metamodel/v2/model"
+	"github.com/pflow-dev/go-metamodel/v2/server"
+	"github.com/pflow-dev/pflow-cli/sealed"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	apiPrefix        = "/api/v1"
+	defaultListLimit = 100
+	maxListLimit     = 1000
+	maxUploadBytes   = 1 << 20
+)
+
+var errBadUpload = errors.New("expected data, model or source")
+
+// blobTable is the storage needed to serve a collection beyond server.BlobAccessor
+type blobTable interface {
+	server.BlobAccessor
+	List(offset, limit int64) []*model.Zblob
+	Update(cid, title, description, keywords string) (bool, error)
+	Delete(cid string) (bool, error)
+}
+
+// collection exposes models or snippets as a REST resource
+type collection struct {
+	kind    string
+	table   blobTable
+	blobs   server.BlobAccessor
+	forget  func(cid string)
+	encode  func(u apiUpload) (cid string, zipped string, err error)
+	content func(b *apiBlob, z *model.Zblob)
+}
+
+type apiBlob struct {
+	Cid         string                       `json:"cid"`
+	Title       string                       `json:"title"`
+	Description string                       `json:"description"`
+	Keywords    string                       `json:"keywords"`
+	Private     bool                         `json:"private"`
+	Created     time.Time                    `json:"created"`
+	Data        string                       `json:"data,omitempty"`
+	Model       *metamodel.DeclarationObject `json:"model,omitempty"`
+	Source      string                       `json:"source,omitempty"`
+}
+
+type apiList struct {
+	Items  []apiBlob `json:"items"`
+	Offset int64     `json:"offset"`
+	Limit  int64     `json:"limit"`
+}
+
+// apiUpload is the POST body: metadata plus one of data (base64 zip), model or source
+// a raw model.json body is detected by its modelType field
+type apiUpload struct {
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	Keywords    string          `json:"keywords"`
+	Data        string          `json:"data"`
+	Model       json.RawMessage `json:"model"`
+	Source      string          `json:"source"`
+	ModelType   string          `json:"modelType"`
+	raw         []byte
+	secret      string
+}
+
+type apiPatch struct {
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+	Keywords    *string `json:"keywords"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func apiFail(w http.ResponseWriter, status int, msg string) {
+	writeJson(w, status, apiError{Error: msg})
+}
+
+func (s *Server) collections() []collection {
+	return []collection{
+		{
+			kind:    "model",
+			table:   s.Store.Model,
+			blobs:   s.App.Model,
+			forget:  s.modelCache.Forget,
+			encode:  encodeModel,
+			content: modelContent,
+		},
+		{
+			kind:    "snippet",
+			table:   s.Store.Snippet,
+			blobs:   s.App.Snippet,
+			forget:  s.snippetCache.Forget,
+			encode:  encodeSnippet,
+			content: snippetContent,
+		},
+	}
+}
+
+func (s *Server) registerApi() {
+	for _, c := range s.collections() {
+		base := apiPrefix + "/" + c.kind + "s"
+		s.Router.HandleFunc(base, s.apiList(c)).Methods(http.MethodGet)
+		s.Router.HandleFunc(base, s.requireWrite(s.apiCreate(c))).Methods(http.MethodPost)
+		s.Router.HandleFunc(base+"/{cid}", s.apiGet(c)).Methods(http.MethodGet)
+		s.Router.HandleFunc(base+"/{cid}", s.requireWrite(s.apiPatch(c))).Methods(http.MethodPatch)
+		s.Router.HandleFunc(base+"/{cid}", s.requireWrite(s.apiDelete(c))).Methods(http.MethodDelete)
+	}
+}
+
+func toApiBlob(z *model.Zblob) apiBlob {
+	return apiBlob{
+		Cid:         z.IpfsCid,
+		Title:       z.Title,
+		Description: z.Description,
+		Keywords:    z.Keywords,
+		Private:     sealed.Is(z.Base64Zipped),
+		Created:     z.CreatedAt,
+	}
+}
+
+func modelContent(b *apiBlob, z *model.Zblob) {
+	if mm, ok := unpackModel(z.Base64Zipped); ok {
+		decl := mm.ToDeclarationObject()
+		b.Model = &decl
+	}
+}
+
+func snippetContent(b *apiBlob, z *model.Zblob) {
+	b.Source, _ = unzipSource(z.Base64Zipped)
+}
+
+// unpackModel loads a base64 zipped model.json, metamodel panics on malformed input
+func unpackModel(zipped string) (mm metamodel.MetaModel, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	mm = metamodel.New()
+	_, ok = mm.UnpackFromUrl("?z="+zipped, "model.json")
+	return mm, ok
+}
+
+func unzipSource(zipped string) (source string, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return metamodel.UnzipUrl("?z="+zipped, "declaration.js")
+}
+
+// encodeModel normalizes an uploaded model the same way CheckForModel does
+// so a model gets the same cid whether it is posted or shared as a ?z= link
+func encodeModel(u apiUpload) (cid string, zipped string, err error) {
+	switch {
+	case u.Data != "":
+		zipped = u.Data
+	case len(u.Model) > 0:
+		zipped, _ = metamodel.ToEncodedZip(u.Model, "model.json")
+	case u.ModelType != "":
+		zipped, _ = metamodel.ToEncodedZip(u.raw, "model.json")
+	default:
+		return "", "", errBadUpload
+	}
+	mm, ok := unpackModel(zipped)
+	if !ok {
+		return "", "", errors.New("invalid model.json")
+	}
+	zipUrl, _ := mm.ZipUrl()
+	zipped = zipUrl[3:]
+	if u.secret != "" {
+		zipped, err = sealed.Seal(u.secret, zipped)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return codec.ToOid(codec.Marshal(zipped)).String(), zipped, nil
+}
+
+func encodeSnippet(u apiUpload) (cid string, zipped string, err error) {
+	source := u.Source
+	if source == "" && u.Data != "" {
+		var ok bool
+		source, ok = unzipSource(u.Data)
+		if !ok {
+			return "", "", errors.New("invalid declaration.js zip")
+		}
+	}
+	if source == "" {
+		return "", "", errBadUpload
+	}
+	zipped, _ = metamodel.ToEncodedZip([]byte(source), "declaration.js")
+	return codec.ToOid(codec.Marshal(source)).String(), zipped, nil
+}
+
+func readUpload(w http.ResponseWriter, r *http.Request) (u apiUpload, status int, err error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return u, http.StatusRequestEntityTooLarge, err
+		}
+		return u, http.StatusBadRequest, err
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "", "application/json":
+		err = json.Unmarshal(body, &u)
+		if err != nil {
+			return u, http.StatusBadRequest, err
+		}
+	case "application/javascript", "text/javascript", "text/plain":
+		u.Source = string(body)
+	default:
+		return u, http.StatusUnsupportedMediaType, errors.New("unsupported content type " + mediaType)
+	}
+	q := r.URL.Query()
+	if u.Title == "" {
+		u.Title = q.Get("title")
+	}
+	if u.Description == "" {
+		u.Description = q.Get("description")
+	}
+	if u.Keywords == "" {
+		u.Keywords = q.Get("keywords")
+	}
+	u.raw = body
+	u.secret, _ = shareSecret(r)
+	return u, http.StatusOK, nil
+}
+
+func (s *Server) apiList(c collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		offset, limit := int64(0), int64(defaultListLimit)
+		q := r.URL.Query()
+		if v := q.Get("offset"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				apiFail(w, http.StatusBadRequest, "offset must be a non-negative integer")
+				return
+			}
+			offset = n
+		}
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 || n > maxListLimit {
+				apiFail(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxListLimit))
+				return
+			}
+			limit = n
+		}
+		list := apiList{Items: []apiBlob{}, Offset: offset, Limit: limit}
+		for _, z := range c.table.List(offset, limit) {
+			list.Items = append(list.Items, toApiBlob(z))
+		}
+		writeJson(w, http.StatusOK, list)
+	}
+}
+
+// lookup finds a stored blob, decrypting private models,
+// and writes an error response when the cid is unknown or the secret is wrong
+func (s *Server) lookup(c collection, w http.ResponseWriter, r *http.Request) (z *model.Zblob, private bool, ok bool) {
+	cid := mux.Vars(r)["cid"]
+	z = c.blobs.GetByCid(cid)
+	if z.IpfsCid != cid || z.ID == 0 {
+		apiFail(w, http.StatusNotFound, c.kind+" not found")
+		return nil, false, false
+	}
+	if sealed.Is(z.Base64Zipped) {
+		opened, status, msg := openSealed(r, z)
+		if status != http.StatusOK {
+			apiFail(w, status, msg)
+			return nil, true, false
+		}
+		w.Header().Set("Cache-Control", "private, no-store")
+		return opened, true, true
+	}
+	return z, false, true
+}
+
+func (s *Server) apiGet(c collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		z, private, ok := s.lookup(c, w, r)
+		if !ok {
+			return
+		}
+		b := toApiBlob(z)
+		b.Private = private
+		b.Data = z.Base64Zipped
+		c.content(&b, z)
+		writeJson(w, http.StatusOK, b)
+	}
+}
+
+func (s *Server) apiCreate(c collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, msg := s.admitClient(w, r); !ok {
+			apiFail(w, http.StatusTooManyRequests, msg)
+			return
+		}
+		u, status, err := readUpload(w, r)
+		if err != nil {
+			apiFail(w, status, err.Error())
+			return
+		}
+		if u.Data != "" {
+			if status, msg := s.checkPayload(r, u.Data); status != http.StatusOK {
+				apiFail(w, status, msg)
+				return
+			}
+		}
+		cid, zipped, err := c.encode(u)
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if existing := c.blobs.GetByCid(cid); existing.IpfsCid == cid && existing.ID != 0 {
+			writeJson(w, http.StatusOK, toApiBlob(existing))
+			return
+		}
+		referrer := r.Header.Get("Referer")
+		id, err := c.blobs.Create(cid, zipped, u.Title, u.Description, u.Keywords, referrer)
+		if err != nil {
+			apiFail(w, http.StatusInternalServerError, "failed to store "+c.kind)
+			return
+		}
+		s.recordEvent(c.kind+"Created", map[string]interface{}{
+			"id":       id,
+			"cid":      cid,
+			"referrer": referrer,
+		})
+		w.Header().Set("Location", link(r, apiPrefix+"/"+c.kind+"s/"+cid))
+		writeJson(w, http.StatusCreated, toApiBlob(c.blobs.GetByCid(cid)))
+	}
+}
+
+func (s *Server) apiPatch(c collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		z, _, ok := s.lookup(c, w, r)
+		if !ok {
+			return
+		}
+		patch := apiPatch{}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUploadBytes)).Decode(&patch)
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		title, description, keywords := z.Title, z.Description, z.Keywords
+		if patch.Title != nil {
+			title = *patch.Title
+		}
+		if patch.Description != nil {
+			description = *patch.Description
+		}
+		if patch.Keywords != nil {
+			keywords = *patch.Keywords
+		}
+		_, err = c.table.Update(z.IpfsCid, title, description, keywords)
+		if err != nil {
+			apiFail(w, http.StatusInternalServerError, "failed to update "+c.kind)
+			return
+		}
+		c.forget(z.IpfsCid)
+		s.recordEvent(c.kind+"Updated", map[string]interface{}{
+			"id":  z.ID,
+			"cid": z.IpfsCid,
+		})
+		writeJson(w, http.StatusOK, toApiBlob(c.blobs.GetByCid(z.IpfsCid)))
+	}
+}
+
+func (s *Server) apiDelete(c collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		z, _, ok := s.lookup(c, w, r)
+		if !ok {
+			return
+		}
+		_, err := c.table.Delete(z.IpfsCid)
+		if err != nil {
+			apiFail(w, http.StatusInternalServerError, "failed to delete "+c.kind)
+			return
+		}
+		c.forget(z.IpfsCid)
+		s.recordEvent(c.kind+"Deleted", map[string]interface{}{
+			"id":  z.ID,
+			"cid": z.IpfsCid,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -1,15 +1,29 @@
 package app
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"github.com/gorilla/mux"
 	"github.com/pflow-dev/go-metamodel/v2/codec"
 	"github.com/pflow-dev/go-metamodel/v2/metamodel"
 	"github.com/pflow-dev/go-metamodel/v2/model"
 	"github.com/pflow-dev/go-metamodel/v2/server"
+	"github.com/pflow-dev/pflow-cli/cache"
+	"github.com/pflow-dev/pflow-cli/car"
+	"github.com/pflow-dev/pflow-cli/ratelimit"
+	"github.com/pflow-dev/pflow-cli/sandbox"
+	"github.com/pflow-dev/pflow-cli/session"
+	"github.com/pflow-dev/pflow-cli/storage"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -24,45 +38,146 @@ _______/ ____\  |   ______  _  __  ___  ______.__.________
 )
 
 type Options struct {
-	Port            string
-	Host            string
-	Url             string
-	DbPath          string
-	NewRelicLicense string
-	NewRelicApp     string
-	LoadExamples    bool
-	UseSandbox      bool
+	Port             string
+	Host             string
+	Url              string // public url, its path is the sub-path the app is mounted under
+	DbPath           string
+	NewRelicLicense  string
+	NewRelicApp      string
+	LoadExamples     bool
+	UseSandbox       bool
+	CacheEntries     int   // per cache entry limit, 0 disables caching
+	CacheBytes       int64 // per cache memory limit, 0 for no limit
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+	IdleTimeout      time.Duration
+	ShutdownTimeout  time.Duration // how long Shutdown waits for in-flight requests
+	IngestRate       float64       // ?z=, upload and snippet evaluation requests per second per client, 0 disables rate limiting
+	IngestBurst      int
+	MaxZippedBytes   int        // limit on a base64 zipped payload, 0 for no limit
+	MaxUnzippedBytes int64      // limit on the inflated files of a payload, 0 for no limit
+	Metrics          bool       // serve /metrics in the Prometheus text format
+	MetricsAddr      string     // serve /metrics on this admin address instead of the main listener
+	LogFormat        string     // text or json
+	LogLevel         slog.Level // records below this level are dropped
+	ReadOnly         bool       // serve stored models but never insert or change rows, events are only logged
+	RequireToken     bool       // writes, including ?z= links, need an api token
+	TrustProxy       bool       // honor X-Forwarded-Proto, -Host, -Prefix and -For
+	ProxyHops        int        // trusted proxies in front of the server, each appends to X-Forwarded-For, 0 means 1
+	TLSCert          string     // certificate file, enables https
+	TLSKey           string
+	TLSSelfSigned    bool          // generate a certificate, written to TLSCert and TLSKey when they are set
+	RedirectPort     string        // plain http port that redirects to https, empty to disable
+	WebhookAttempts  int           // attempts before a delivery is dead-lettered
+	WebhookBackoff   time.Duration // delay after the first failed attempt, doubled for each retry
+	WebhookTimeout   time.Duration
+	MaxSessions      int           // running simulation sessions kept in memory
+	SessionIdle      time.Duration // sessions without subscribers are dropped after this when the limit is reached
+	EditorDir        string        // serve /p from this editor build directory, uncached and reloaded on change
+	SnippetTimeout   time.Duration // how long a declaration.js snippet may run when rendered
+	SnippetMemory    int64         // largest string or array a snippet may allocate at once, 0 for the default
 }
 
 type Server struct {
-	App         *server.App
-	Logger      *log.Logger
-	Options     Options
-	Router      *mux.Router
-	indexPage   *template.Template
-	sandboxPage *template.Template
+	App           *server.App
+	Store         *storage.Storage
+	Logger        *slog.Logger
+	Options       Options
+	Router        *mux.Router
+	indexPage     *template.Template
+	sandboxPage   *template.Template
+	modelCache    cache.Blobs
+	snippetCache  cache.Blobs
+	renderCache   *cache.LRU
+	pngSlots      chan struct{}           // one per cpu, rasterizing is the most expensive render
+	Static        http.Handler            // serves the editor assets under /p, nil responds 404
+	editors       map[string]*editorBuild // by version, see LoadEditorAssets
+	editorMu      sync.RWMutex            // guards Static and editors, replaced when EditorDir changes
+	dev           *devReloader            // live reload when EditorDir is set
+	sandboxFiles  http.Handler            // verified sandbox assets, see LoadSandboxAssets
+	sandboxHashes sandbox.Manifest
+	httpServer    *http.Server
+	redirect      *http.Server
+	certs         *certLoader
+	handler       http.Handler // Router wrapped with the access log
+	admin         *http.Server
+	metrics       *serverMetrics
+	unzipFailures atomic.Uint64
+	ingestLimiter *ratelimit.Limiter
+	ingest        ingestCounters
+	webhooks      *webhookDispatcher
+	views         *viewRecorder
+	sessions      *session.Manager
+	closeStore    sync.Once
 }
 
-func New(store server.Storage, options Options) *Server {
+func New(store *storage.Storage, options Options) *Server {
 	s := &Server{
+		Store:   store,
 		Options: options,
 		Router:  mux.NewRouter(),
 	}
 	s.App = &server.App{
 		Service: s,
-		Storage: store,
+		Storage: s.newCaches(store),
+	}
+	s.Logger = NewLogger(os.Stderr, s.Options.LogFormat, s.Options.LogLevel)
+	s.ingestLimiter = ratelimit.New(s.Options.IngestRate, s.Options.IngestBurst)
+	s.pngSlots = make(chan struct{}, runtime.GOMAXPROCS(0))
+	s.webhooks = newWebhookDispatcher(s.Options.WebhookTimeout)
+	s.views = newViewRecorder()
+	s.sessions = session.NewManager(s.Options.MaxSessions, s.Options.SessionIdle)
+	if s.metricsEnabled() {
+		s.metrics = s.newMetrics()
+	}
+	if s.Options.MetricsAddr != "" {
+		adminRouter := http.NewServeMux()
+		adminRouter.HandleFunc(metricsPath, s.MetricsHandler)
+		adminRouter.HandleFunc(healthzPath, s.HealthzHandler)
+		adminRouter.HandleFunc(readyzPath, s.ReadyzHandler)
+		s.admin = &http.Server{
+			Addr:              s.Options.MetricsAddr,
+			Handler:           adminRouter,
+			ReadHeaderTimeout: s.Options.ReadTimeout,
+			ErrorLog:          slog.NewLogLogger(s.Logger.Handler(), slog.LevelError),
+		}
+	}
+	s.httpServer = &http.Server{
+		Addr:         s.Options.Host + ":" + s.Options.Port,
+		Handler:      s,
+		ReadTimeout:  s.Options.ReadTimeout,
+		WriteTimeout: s.Options.WriteTimeout,
+		IdleTimeout:  s.Options.IdleTimeout,
+		ErrorLog:     slog.NewLogLogger(s.Logger.Handler(), slog.LevelError),
+	}
+	s.httpServer.RegisterOnShutdown(s.sessions.Close)
+	s.dev = newDevReloader()
+	s.httpServer.RegisterOnShutdown(s.dev.Close)
+	if s.tlsEnabled() {
+		s.certs = s.newCertLoader()
+		s.httpServer.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: s.certs.GetCertificate,
+		}
+		if s.Options.RedirectPort != "" {
+			s.redirect = &http.Server{
+				Addr:              s.Options.Host + ":" + s.Options.RedirectPort,
+				Handler:           http.HandlerFunc(s.redirectHandler),
+				ReadHeaderTimeout: s.Options.ReadTimeout,
+				ErrorLog:          slog.NewLogLogger(s.Logger.Handler(), slog.LevelError),
+			}
+		}
 	}
-	s.Logger = log.Default()
 	if s.Options.UseSandbox {
-	  s.Logger.Printf("Sandbox enabled")
+		s.Logger.Info("sandbox enabled")
 		sandboxSource := s.SandboxTemplateSource()
 		s.sandboxPage = template.Must(template.New("sandbox.html").Parse(sandboxSource))
 	}
 	indexSource := s.IndexTemplateSource()
 	s.indexPage = template.Must(template.New("index.html").Parse(indexSource))
+	s.routes()
 
-	s.Logger.Printf("DBPath: %s\n", s.Options.DbPath)
-	s.Logger.Printf("Listening on %s:%s\n", s.Options.Host, s.Options.Port)
+	s.Logger.Info("database", "path", s.Options.DbPath)
 	return s
 }
 
@@ -75,28 +190,135 @@ func (s *Server) SandboxPage() *template.Template {
 }
 
 func (s *Server) PrintLinks(m model.Model, url string) {
-	s.Logger.Printf("- model[%d] %s\n", m.ID, m.Title)
-	s.Logger.Printf("  %s/p/%s/\n", url, m.IpfsCid)
-	s.Logger.Printf("  %s/src/%s.json\n", url, m.IpfsCid)
-	s.Logger.Printf("  %s/img/%s.svg\n", url, m.IpfsCid)
+	s.Logger.Info("model",
+		"id", m.ID,
+		"title", m.Title,
+		"cid", m.IpfsCid,
+		"page", url+"/p/"+m.IpfsCid+"/",
+		"json", url+"/src/"+m.IpfsCid+".json",
+		"svg", url+"/img/"+m.IpfsCid+".svg",
+	)
 }
 
-func (s *Server) ServeHTTP(appHandler http.Handler) {
-	s.WrapHandler("/p/", s.App.AppPage)
-	s.WrapHandler("/p/{pflowCid}/", s.App.AppPage)
-	s.WrapHandler("/img/", s.App.SvgHandler)
-	s.WrapHandler("/img/{pflowCid}.svg", s.App.SvgHandler)
-	s.WrapHandler("/src/", s.App.JsonHandler)
-	s.WrapHandler("/src/{pflowCid}.json", s.App.JsonHandler)
-	if s.Options.UseSandbox {
-		s.WrapHandler("/sandbox/", s.App.SandboxHandler)
-		s.WrapHandler("/sandbox/{pflowCid}/", s.App.SandboxHandler)
+// ServeHTTP implements http.Handler so a Server can be mounted in another mux or wrapped with middleware
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves on Options.Host:Options.Port until Shutdown is called
+// it returns nil after a graceful shutdown
+func (s *Server) ListenAndServe() error {
+	s.startWebhooks()
+	s.startDevReload()
+	if s.admin != nil {
+		go func() {
+			s.Logger.Info("serving metrics", "addr", s.admin.Addr)
+			err := serveUntilShutdown(s.admin.ListenAndServe())
+			if err != nil {
+				s.Logger.Error("metrics listener failed", "err", err)
+			}
+		}()
+	}
+	if !s.tlsEnabled() {
+		s.Logger.Info("listening", "addr", s.httpServer.Addr)
+		return serveUntilShutdown(s.httpServer.ListenAndServe())
 	}
-	s.Router.PathPrefix("/p").Handler(appHandler)
-	err := http.ListenAndServe(s.Options.Host+":"+s.Options.Port, s.Router)
+	err := s.certs.load()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if s.redirect != nil {
+		go func() {
+			s.Logger.Info("redirecting http to https", "addr", s.redirect.Addr)
+			err := serveUntilShutdown(s.redirect.ListenAndServe())
+			if err != nil {
+				s.Logger.Error("redirect listener failed", "err", err)
+			}
+		}()
+	}
+	s.Logger.Info("listening", "addr", s.httpServer.Addr, "tls", true)
+	return serveUntilShutdown(s.httpServer.ListenAndServeTLS("", ""))
+}
+
+func serveUntilShutdown(err error) error {
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting connections, waits for in-flight requests until ctx expires
+// and then closes the store so queued writes are committed before the process exits
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.httpServer.Shutdown(ctx)
+	for _, extra := range []*http.Server{s.redirect, s.admin} {
+		if extra != nil {
+			_ = extra.Shutdown(ctx)
+		}
+	}
+	s.stopViews()
+	s.stopWebhooks()
+	s.closeStore.Do(func() {
+		closeErr := s.Store.Close()
+		if err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
+
+// routes registers every handler on s.Router, new routes must also be described in OpenApi
+func (s *Server) routes() {
+	s.handler = s.mount(s.accessLog(s.Router))
+	s.Router.Use(routeInfo)
+	s.WrapHandler("/p/", s.limitIngest(s.AppPage))
+	s.WrapHandler("/p/{pflowCid}/", s.limitIngest(s.AppPage))
+	s.WrapHandler("/img/", s.limitIngest(s.SvgHandler))
+	s.WrapHandler("/img/{pflowCid}.svg", s.limitIngest(s.SvgHandler))
+	s.WrapHandler("/img/{pflowCid}.png", s.PngHandler)
+	s.WrapHandler("/src/", s.limitIngest(s.JsonHandler))
+	s.WrapHandler("/src/{pflowCid}.json", s.limitIngest(s.JsonHandler))
+	if s.Options.UseSandbox {
+		// registered first, /sandbox/{pflowCid}/ would match static/
+		s.Router.PathPrefix(sandboxStaticPath).HandlerFunc(s.SandboxAssetHandler).Methods(http.MethodGet)
+		s.WrapHandler("/sandbox/", s.limitIngest(s.SandboxHandler))
+		s.WrapHandler("/sandbox/{pflowCid}/", s.limitIngest(s.SandboxHandler))
 	}
+	s.WrapHandler("/car/{pflowCid}.car", s.CarHandler)
+	s.WrapHandler("/embed/{pflowCid}", s.EmbedHandler)
+	s.Router.HandleFunc(oembedPath, s.OembedHandler).Methods(http.MethodGet)
+	s.Router.HandleFunc("/api/events", s.EventsHandler).Methods(http.MethodGet)
+	s.Router.HandleFunc("/api/cache", s.CacheHandler).Methods(http.MethodGet)
+	s.Router.HandleFunc("/api/limits", s.LimitsHandler).Methods(http.MethodGet)
+	s.Router.HandleFunc(healthzPath, s.HealthzHandler).Methods(http.MethodGet)
+	s.Router.HandleFunc(readyzPath, s.ReadyzHandler).Methods(http.MethodGet)
+	if s.metrics != nil && s.admin == nil {
+		s.Router.HandleFunc(metricsPath, s.MetricsHandler).Methods(http.MethodGet)
+	}
+	if s.devMode() {
+		s.Router.HandleFunc(devEventsPath, s.DevEventsHandler).Methods(http.MethodGet)
+	}
+	s.Router.HandleFunc(openApiPath, s.OpenApiHandler).Methods(http.MethodGet)
+	s.registerApi()
+	s.registerSessions()
+	// static assets of the editor, not part of the api
+	s.Router.PathPrefix("/p").HandlerFunc(s.staticHandler).Name(staticRoute)
+}
+
+const staticRoute = "static"
+
+func (s *Server) staticHandler(w http.ResponseWriter, r *http.Request) {
+	s.editorMu.RLock()
+	static := s.Static
+	s.editorMu.RUnlock()
+	if static == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if s.devMode() {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	static.ServeHTTP(w, r)
 }
 
 func (s *Server) WrapHandler(pattern string, handler server.HandlerWithVars) {
@@ -107,28 +329,89 @@ func (s *Server) WrapHandler(pattern string, handler server.HandlerWithVars) {
 			handler(vars, w, r)
 		})
 }
+
+// CarHandler serves a single model or snippet as a CARv1 archive
+func (s *Server) CarHandler(vars map[string]string, w http.ResponseWriter, r *http.Request) {
+	cid := vars["pflowCid"]
+	var models, snippets []*model.Zblob
+	if m := s.App.Model.GetByCid(cid); m.IpfsCid == cid {
+		models = append(models, m)
+	} else if sn := s.App.Snippet.GetByCid(cid); sn.IpfsCid == cid {
+		snippets = append(snippets, sn)
+	} else {
+		http.NotFound(w, r)
+		return
+	}
+	buf := new(bytes.Buffer)
+	skipped, err := car.Export(buf, models, snippets)
+	if err != nil {
+		http.Error(w, "Failed to export car", http.StatusInternalServerError)
+		return
+	}
+	if len(skipped) > 0 {
+		http.Error(w, "Stored cid does not match content", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.ipld.car; version=1")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+cid+`.car"`)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// Event logs an event and records it when anonymous requests may write,
+// it is the server.Service hook for callers without a request
 func (s *Server) Event(eventType string, params map[string]interface{}) {
-	data, _ := json.Marshal(params)
-	s.Logger.Printf("%s => %s\n", eventType, data)
+	s.event(eventType, params, s.anonymousWrite())
+}
+
+// recordEvent logs and records an event caused by a write that was already allowed
+func (s *Server) recordEvent(eventType string, params map[string]interface{}) {
+	s.event(eventType, params, !s.Options.ReadOnly)
+}
+
+// event logs an event, when record is set it is also appended to the journal and queued for
+// subscribed webhooks, so requests that may not write cannot add rows by viewing pages
+func (s *Server) event(eventType string, params map[string]interface{}, record bool) {
+	s.Logger.Info("event", slog.String("type", eventType), slog.Group("params", mapAttrs(params)...))
+	if !record {
+		return
+	}
+	id, err := s.Store.Events.Append(eventType, params)
+	if err != nil {
+		s.Logger.Error("failed to record event", "type", eventType, "err", err)
+		return
+	}
+	s.notifyWebhooks(storage.Event{ID: id, Type: eventType, Params: params, CreatedAt: time.Now().UTC()})
 }
+
+// hostUrl is the base url for links when only the request host is known
+func (s *Server) hostUrl(hostname string) string {
+	return s.scheme() + "://" + hostname + s.basePath()
+}
+
+// CheckForModel stores a ?z= model when anonymous requests may write, otherwise it only finds stored models
 func (s *Server) CheckForModel(hostname string, url string, referrer string) (string, bool) {
+	return s.storeModel(s.hostUrl(hostname), url, referrer, s.anonymousWrite())
+}
+
+// storeModel stores a ?z= model, base is used for the link recorded with the event,
+// without write it only reports whether the model is already stored
+func (s *Server) storeModel(base string, url string, referrer string, write bool) (string, bool) {
 	defer func() {
 		if r := recover(); r != nil {
-			s.Logger.Printf("Recovered from panic in CheckForModel: %v", r)
+			s.Logger.Error("recovered from panic in CheckForModel", "panic", r)
 		}
 	}()
-	mm := metamodel.New()
-	_, foundInUrl := mm.UnpackFromUrl(url, "model.json")
+	cid, zippedData, foundInUrl := s.modelFromUrl(url)
 	if foundInUrl {
-		zippedData, _ := mm.ZipUrl()
-		zippedData = zippedData[3:]
-		cid := codec.ToOid(codec.Marshal(zippedData)).String()
+		if !write {
+			return cid, s.App.Model.GetByCid(cid).IpfsCid == cid
+		}
 		id, err := s.App.Model.Create(cid, zippedData, "Untitled", "", "", referrer)
 		if err != nil {
 			id = s.App.Model.GetByCid(cid).ID
 		}
-		linkUrl := "https://" + hostname + "/p/" + cid + "/"
-		s.Event("modelUnzipped", map[string]interface{}{
+		linkUrl := base + "/p/" + cid + "/"
+		s.recordEvent("modelUnzipped", map[string]interface{}{
 			"id":       id,
 			"cid":      cid,
 			"link":     linkUrl,
@@ -139,23 +422,24 @@ func (s *Server) CheckForModel(hostname string, url string, referrer string) (st
 	return "", false
 }
 
+// CheckForSnippet stores a ?z= snippet when anonymous requests may write, otherwise it only finds stored snippets
 func (s *Server) CheckForSnippet(hostname string, url string, referrer string) (string, bool) {
+	return s.storeSnippet(s.hostUrl(hostname), url, referrer, s.anonymousWrite())
+}
+
+func (s *Server) storeSnippet(base string, url string, referrer string, write bool) (string, bool) {
 	defer func() {
 		if r := recover(); r != nil {
-			s.Logger.Printf("Recovered from panic in CheckForSnippet: %v", r)
+			s.Logger.Error("recovered from panic in CheckForSnippet", "panic", r)
 		}
 	}()
-	srcUrl := "https://" + hostname + url
-	sourceCode, foundInUrl := metamodel.UnzipUrl(srcUrl, "declaration.js")
-	if !foundInUrl { // try to convert a model to a snippet
-		sourceCode, foundInUrl = metamodel.UnzipUrl(srcUrl, "model.json")
-		if !foundInUrl {
-			return "", false
-		} else {
-			sourceCode = "const declaration = " + sourceCode
-		}
+	cid, sourceCode, foundInUrl := s.snippetFromUrl(url)
+	if !foundInUrl {
+		return "", false
+	}
+	if !write {
+		return cid, s.App.Snippet.GetByCid(cid).IpfsCid == cid
 	}
-	cid := codec.ToOid(codec.Marshal(sourceCode)).String()
 	zippedCode, _ := metamodel.ToEncodedZip([]byte(sourceCode), "declaration.js")
 	_, err := s.App.Storage.Snippet.Create(cid, zippedCode, "", "", "", referrer)
 	if err != nil {
@@ -167,8 +451,8 @@ func (s *Server) CheckForSnippet(hostname string, url string, referrer string) (
 		http.Error(nil, "Failed to load snippet by cid", http.StatusInternalServerError)
 		return "", false
 	}
-	linkUrl := "https://" + hostname + "/sandbox/" + cid + "/"
-	s.Event("sandboxUnzipped", map[string]interface{}{
+	linkUrl := base + "/sandbox/" + cid + "/"
+	s.recordEvent("sandboxUnzipped", map[string]interface{}{
 		"id":       res.ID,
 		"cid":      cid,
 		"link":     linkUrl,
@@ -177,6 +461,43 @@ func (s *Server) CheckForSnippet(hostname string, url string, referrer string) (
 	return cid, true
 }
 
+// modelFromUrl reads a ?z= model and returns its normalized zip along with the cid it is stored under
+func (s *Server) modelFromUrl(url string) (cid string, zippedData string, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.unzipFailed(r)
+			ok = false
+		}
+	}()
+	mm := metamodel.New()
+	_, foundInUrl := mm.UnpackFromUrl(url, "model.json")
+	if !foundInUrl {
+		return "", "", false
+	}
+	zippedData, _ = mm.ZipUrl()
+	zippedData = zippedData[3:]
+	return codec.ToOid(codec.Marshal(zippedData)).String(), zippedData, true
+}
+
+// snippetFromUrl reads ?z= javascript source, a model is converted to a snippet declaring it
+func (s *Server) snippetFromUrl(url string) (cid string, sourceCode string, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.unzipFailed(r)
+			ok = false
+		}
+	}()
+	sourceCode, foundInUrl := metamodel.UnzipUrl(url, "declaration.js")
+	if !foundInUrl { // try to convert a model to a snippet
+		sourceCode, foundInUrl = metamodel.UnzipUrl(url, "model.json")
+		if !foundInUrl {
+			return "", "", false
+		}
+		sourceCode = "const declaration = " + sourceCode
+	}
+	return codec.ToOid(codec.Marshal(sourceCode)).String(), sourceCode, true
+}
+
 func (*Server) GetState(r *http.Request) (state metamodel.Vector, ok bool) {
 	q := r.URL.Query()
 	rawState := q.Get("state")
@@ -194,16 +515,40 @@ func (*Server) GetState(r *http.Request) (state metamodel.Vector, ok bool) {
 func (s *Server) IndexTemplateSource() string {
 	out := `<!DOCTYPE html>
 <html lang="en"><head><meta charset="utf-8"/>
-	<title>pflow | metamodel explorer</title>
+	<title>{{with .Title}}{{.}} | pflow{{else}}pflow | metamodel explorer{{end}}</title>
 	<meta name="viewport" content="width=device-width,initial-scale=1"/>
 	<meta name="theme-color" content="#000000"/>
-	<meta name="description" content="pflow metamodel editor"/>
-	<link rel="icon" href="/p/favicon.ico"/>
-	<link rel="apple-touch-icon" href="/p/logo192.png"/>
-	<link rel="manifest" href="/p/manifest.json"/>
-	<link href="/p/static/css/main.9e6325dd.css" rel="stylesheet">`
+	<meta name="description" content="{{with .Description}}{{.}}{{else}}pflow metamodel editor{{end}}"/>
+	{{- with .Meta}}
+	<link rel="canonical" href="{{.Canonical}}"/>
+	<meta property="og:type" content="website"/>
+	<meta property="og:site_name" content="pflow"/>
+	<meta property="og:url" content="{{.Canonical}}"/>
+	<meta property="og:title" content="{{with $.Title}}{{.}}{{else}}pflow model{{end}}"/>
+	<meta property="og:description" content="{{with $.Description}}{{.}}{{else}}Petri-net model made with pflow{{end}}"/>
+	<meta property="og:image" content="{{.Image}}"/>
+	<meta property="og:image:type" content="image/png"/>
+	<meta property="og:image:width" content="{{.ImageWidth}}"/>
+	<meta property="og:image:height" content="{{.ImageHeight}}"/>
+	<meta name="twitter:card" content="summary_large_image"/>
+	<meta name="twitter:title" content="{{with $.Title}}{{.}}{{else}}pflow model{{end}}"/>
+	<meta name="twitter:description" content="{{with $.Description}}{{.}}{{else}}Petri-net model made with pflow{{end}}"/>
+	<meta name="twitter:image" content="{{.Image}}"/>
+	<link rel="alternate" type="application/json+oembed" href="{{.Oembed}}" title="{{$.Title}}"/>
+	{{- end}}
+	{{- with .Editor}}
+	<link rel="icon" href="{{$.Base}}{{.Prefix}}favicon.ico"/>
+	<link rel="apple-touch-icon" href="{{$.Base}}{{.Prefix}}logo192.png"/>
+	<link rel="manifest" href="{{$.Base}}{{.Prefix}}manifest.json"/>
+	{{- range .Styles}}
+	<link href="{{$.Base}}{{.}}" rel="stylesheet">
+	{{- end}}
+	{{- end}}`
 	out += SessionDataScript
-	out += `<script defer="defer" src=/p/static/js/main.8954f887.js></script>
+	out += `{{range .Editor.Scripts}}<script defer="defer" src="{{$.Base}}{{.}}"></script>{{end}}
+{{- if .Dev}}
+<script>new EventSource("{{.Base}}/api/dev/events").addEventListener("reload", () => location.reload());</script>
+{{- end}}
 
 </head>
 <body>
@@ -213,7 +558,7 @@ func (s *Server) IndexTemplateSource() string {
 	return out
 }
 
-// NOTE: currenlty we load js code from a CDN - this feature disabled by default
+// SandboxTemplateSource loads every script from /sandbox/static/, see the sandbox package
 func (s *Server) SandboxTemplateSource() string {
 	return SandBoxStaticTemplateHead + SandBoxStaticTemplateRest
 }
@@ -222,6 +567,7 @@ const (
 	SessionDataScript = `<script>
 	sessionStorage.cid = "{{.IpfsCid}}";
 	sessionStorage.data = "{{.Base64Zipped}}";
+	sessionStorage.base = "{{.Base}}";
 </script>`
 
 	SandBoxStaticTemplateHead = `<!DOCTYPE html>
@@ -229,30 +575,23 @@ const (
 <head>
     <title>pflow.dev | js sandbox </title>
     <meta charset="utf-8"/>
-    <script src="https://cdn.jsdelivr.net/npm/jquery"></script>
-    <script src="https://cdn.jsdelivr.net/npm/jquery.terminal/js/jquery.terminal.min.js"></script>
-    <link href="https://cdn.jsdelivr.net/npm/jquery.terminal/css/jquery.terminal.min.css" rel="stylesheet"/>
-    <script src="https://cdn.jsdelivr.net/npm/ace-builds@1.16.0/src-min-noconflict/ace.min.js "></script>
-    <script src="https://cdn.jsdelivr.net/npm/jszip@3.10.1/dist/jszip.min.js"></script>
-    <link href="https://cdn.jsdelivr.net/gh/pFlow-dev/pflow-js@v1.0.2/styles/pflow.css" rel="stylesheet"/>`
+    <script src="{{.Base}}/sandbox/static/jquery.min.js" integrity="{{index .Integrity "jquery.min.js"}}"></script>
+    <script src="{{.Base}}/sandbox/static/jquery.terminal.min.js" integrity="{{index .Integrity "jquery.terminal.min.js"}}"></script>
+    <link href="{{.Base}}/sandbox/static/jquery.terminal.min.css" integrity="{{index .Integrity "jquery.terminal.min.css"}}" rel="stylesheet"/>
+    <script src="{{.Base}}/sandbox/static/ace/ace.js" integrity="{{index .Integrity "ace/ace.js"}}"></script>
+    <script>
+        ace.config.set("basePath", "{{.Base}}/sandbox/static/ace");
+    </script>
+    <script src="{{.Base}}/sandbox/static/jszip.min.js" integrity="{{index .Integrity "jszip.min.js"}}"></script>
+    <link href="{{.Base}}/sandbox/static/pflow.css" integrity="{{index .Integrity "pflow.css"}}" rel="stylesheet"/>`
 
 	SandBoxStaticTemplateRest = `
-    <script src="https://cdn.jsdelivr.net/gh/pflow-dev/pflow-js@v1.0.2/src/pflow.js"></script>
+    <script src="{{.Base}}/sandbox/static/pflow.js" integrity="{{index .Integrity "pflow.js"}}"></script>
     <script>
         defaultPflowSandboxOptions.vim = false;
     </script>
 </head>
 <body onload=(runPflowSandbox())>
-<table id="cdn-stats">
-<tr><td>
-<a href="https://www.jsdelivr.com/package/gh/pflow-dev/pflow-js" rel="nofollow noopener noreferrer" class="router-ignore"><img alt="" src="https://data.jsdelivr.com/v1/package/gh/pflow-dev/pflow-js/badge" loading="lazy"></a>
-</td><td>
-&nbsp;&nbsp;&nbsp;
-</td><td>
-<iframe src="https://ghbtns.com/github-btn.html?user=pFlow-dev&repo=pflow-js&type=star&count=true&size=large" frameborder="0" scrolling="0" width="130" height="40" title="GitHub">
-</iframe>
-</td></tr>
-</table>
 <table id="heading">
 <tr><td>
 <a class="pflow-link" target="_blank" href="./">
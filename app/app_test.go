@@ -0,0 +1,1318 @@
+package app
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/pflow-dev/go-metamodel/v2/metamodel"
+	. "github.com/pflow-dev/pflow-cli/internal/examples"
+	"github.com/pflow-dev/pflow-cli/sandbox"
+	"github.com/pflow-dev/pflow-cli/sealed"
+	"github.com/pflow-dev/pflow-cli/storage"
+	"image/png"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, options Options) *Server {
+	store := storage.New(storage.ResetDb(filepath.Join(t.TempDir(), "pflow.db")))
+	t.Cleanup(func() { _ = store.Close() })
+	return New(store, options)
+}
+
+// storePrivate opens a ?z= link with a share secret the way the editor does and returns the sealed cid
+func storePrivate(t *testing.T, s *Server, secret string) string {
+	req := httptest.NewRequest(http.MethodGet, "/p/?z="+InhibitorTest.Base64Zipped, nil)
+	req.Header.Set("Authorization", "Secret "+secret)
+	cid, ok := s.checkForModel(req)
+	if !ok || cid == InhibitorTest.IpfsCid {
+		t.Fatalf("failed to store private model, got %s", cid)
+	}
+	return cid
+}
+
+func TestPrivateModel(t *testing.T) {
+	s := newTestServer(t, Options{CacheEntries: 16})
+	loadEditor(t, s)
+	secret := sealed.NewSecret()
+	cid := storePrivate(t, s, secret)
+	stored := s.Store.Model.GetByCid(cid)
+	if !sealed.Is(stored.Base64Zipped) || strings.Contains(stored.Base64Zipped, InhibitorTest.Base64Zipped) {
+		t.Fatal("expected ciphertext at rest")
+	}
+
+	for _, tc := range []struct {
+		auth   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Secret wrong", http.StatusForbidden},
+		{"Secret " + secret, http.StatusOK},
+		{"", http.StatusUnauthorized}, // a successful render must not be cached for everyone
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/img/"+cid+".svg", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		s.SvgHandler(map[string]string{"pflowCid": cid}, rec, req)
+		if rec.Code != tc.status {
+			t.Fatalf("auth %q: expected %d got %d", tc.auth, tc.status, rec.Code)
+		}
+		if tc.status == http.StatusOK && !strings.Contains(rec.Body.String(), "<svg") {
+			t.Fatalf("expected svg, got %s", rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.AppPage(map[string]string{"pflowCid": cid}, rec, httptest.NewRequest(http.MethodGet, "/p/"+cid+"/", nil))
+	if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), "location.hash") {
+		t.Fatalf("expected fragment bootstrap page, got %d", rec.Code)
+	}
+}
+
+func TestModelApi(t *testing.T) {
+	s := newTestServer(t, Options{CacheEntries: 16})
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+	modelJson := `{"modelType": "petriNet", "version": "v0", "places": {"foo": {"offset": 0, "initial": 1, "x": 100, "y": 100}}, "transitions": {"inc": {"x": 200, "y": 100}}, "arcs": [{"source": "inc", "target": "foo"}]}`
+
+	rec := do(http.MethodPost, "/api/v1/models?title=counter", modelJson)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+	created := apiBlob{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &created)
+	if created.Cid == "" || created.Title != "counter" || rec.Header().Get("Location") != "/api/v1/models/"+created.Cid {
+		t.Fatalf("unexpected create response: %s", rec.Body)
+	}
+	if rec = do(http.MethodPost, "/api/v1/models", modelJson); rec.Code != http.StatusOK {
+		t.Fatalf("duplicate create: %d %s", rec.Code, rec.Body)
+	}
+	if rec = do(http.MethodPost, "/api/v1/models", `{"data": "not a zip"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid create: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = do(http.MethodPatch, "/api/v1/models/"+created.Cid, `{"description": "counts"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"description":"counts"`) {
+		t.Fatalf("patch: %d %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodGet, "/api/v1/models/"+created.Cid, "")
+	fetched := apiBlob{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &fetched)
+	if rec.Code != http.StatusOK || fetched.Title != "counter" || fetched.Description != "counts" || fetched.Model == nil || len(fetched.Model.Places) != 1 {
+		t.Fatalf("get: %d %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodGet, "/api/v1/models?limit=10", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), created.Cid) {
+		t.Fatalf("list: %d %s", rec.Code, rec.Body)
+	}
+
+	if rec = do(http.MethodDelete, "/api/v1/models/"+created.Cid, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", rec.Code, rec.Body)
+	}
+	if rec = do(http.MethodGet, "/api/v1/models/"+created.Cid, ""); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), `"error"`) {
+		t.Fatalf("get deleted: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestOpenApiCoversRoutes(t *testing.T) {
+	s := newTestServer(t, Options{UseSandbox: true, Metrics: true, EditorDir: t.TempDir()})
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, openApiPath, nil))
+	doc := openApiDoc{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("openapi: %d %v", rec.Code, err)
+	}
+
+	registered := map[string]bool{}
+	err := s.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if route.GetName() == staticRoute {
+			return nil
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{http.MethodGet}
+		}
+		for _, method := range methods {
+			registered[path+" "+method] = true
+			if doc.Paths[path][strings.ToLower(method)] == nil {
+				t.Errorf("%s %s is registered but not documented", method, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			if !registered[path+" "+strings.ToUpper(method)] {
+				t.Errorf("%s %s is documented but not registered", method, path)
+			}
+		}
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	s := newTestServer(t, Options{})
+	started, release := make(chan struct{}), make(chan struct{})
+	s.Router.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("done"))
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.httpServer.Serve(ln) }()
+
+	response := make(chan string, 1)
+	go func() {
+		res, err := http.Get("http://" + ln.Addr().String() + "/slow")
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body := new(strings.Builder)
+		_, _ = io.Copy(body, res.Body)
+		response <- body.String()
+	}()
+	<-started
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.Shutdown(context.Background()) }()
+	select {
+	case <-stopped:
+		t.Fatal("shutdown returned before the in-flight request finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if body := <-response; body != "done" {
+		t.Fatalf("in-flight request was not drained: %s", body)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Store.Model.Create("cid", "data", "", "", "", ""); err == nil {
+		t.Fatal("expected store to be closed after shutdown")
+	}
+}
+
+func TestMountedHandler(t *testing.T) {
+	s := newTestServer(t, Options{})
+	s.Static = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("static " + r.URL.Path))
+	})
+	ts := httptest.NewServer(http.StripPrefix("/pflow", s))
+	defer ts.Close()
+
+	for path, want := range map[string]string{
+		"/pflow/p/static/main.js": "static /p/static/main.js",
+		"/pflow" + openApiPath:    `"openapi":"3.0.3"`,
+	} {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if res.StatusCode != http.StatusOK || !strings.Contains(string(body), want) {
+			t.Fatalf("%s: %d %s", path, res.StatusCode, body)
+		}
+	}
+}
+
+func TestSelfSignedReload(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestServer(t, Options{
+		Port:          "8443",
+		TLSCert:       filepath.Join(dir, "cert.pem"),
+		TLSKey:        filepath.Join(dir, "key.pem"),
+		TLSSelfSigned: true,
+	})
+	if err := s.ReloadCertificates(); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := s.certs.GetCertificate(nil)
+
+	// replacing the files, as a renewal would, takes effect on the next reload
+	certPem, keyPem, err := selfSignedCert([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = os.WriteFile(s.Options.TLSCert, certPem, 0644)
+	_ = os.WriteFile(s.Options.TLSKey, keyPem, 0600)
+	if err := s.ReloadCertificates(); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := s.certs.GetCertificate(nil)
+	if bytes.Equal(first.Certificate[0], second.Certificate[0]) {
+		t.Fatal("expected a new certificate after reload")
+	}
+
+	_ = os.WriteFile(s.Options.TLSCert, []byte("garbage"), 0644)
+	if err := s.ReloadCertificates(); err == nil {
+		t.Fatal("expected an error for an invalid certificate")
+	}
+	if kept, _ := s.certs.GetCertificate(nil); kept != second {
+		t.Fatal("a failed reload must keep the previous certificate")
+	}
+
+	rec := httptest.NewRecorder()
+	s.redirectHandler(rec, httptest.NewRequest(http.MethodPost, "http://example.com:8080/api/v1/models?title=x", nil))
+	if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != "https://example.com:8443/api/v1/models?title=x" {
+		t.Fatalf("redirect: %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+
+	cid, _ := s.CheckForModel("example.com", "/p/?z="+InhibitorTest.Base64Zipped, "")
+	events, _ := s.Store.Events.Query(storage.EventQuery{Type: "modelUnzipped"})
+	if len(events) != 1 || events[0].Params["link"] != "https://example.com/p/"+cid+"/" {
+		t.Fatalf("expected https link, got %v", events)
+	}
+}
+
+func TestWriteAccess(t *testing.T) {
+	zUrl := "/img/?z=" + InhibitorTest.Base64Zipped
+	svg := func(s *Server, token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, zUrl, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		s.SvgHandler(map[string]string{}, rec, req)
+		return rec
+	}
+
+	readOnly := newTestServer(t, Options{ReadOnly: true})
+	if rec := svg(readOnly, ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<svg") {
+		t.Fatalf("expected ephemeral render, got %d", rec.Code)
+	}
+	if readOnly.Store.Model.GetByCid(InhibitorTest.IpfsCid).ID != 0 {
+		t.Fatal("read-only server stored a model")
+	}
+	readOnly.Event("modelViewed", map[string]interface{}{"cid": InhibitorTest.IpfsCid})
+	if events, _ := readOnly.Store.Events.Query(storage.EventQuery{}); len(events) != 0 {
+		t.Fatalf("read-only server recorded events %+v", events)
+	}
+	rec := httptest.NewRecorder()
+	readOnly.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/models", strings.NewReader(`{"data": "`+InhibitorTest.Base64Zipped+`"}`)))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 from read-only api, got %d", rec.Code)
+	}
+
+	s := newTestServer(t, Options{RequireToken: true})
+	_ = svg(s, "")
+	if s.Store.Model.GetByCid(InhibitorTest.IpfsCid).ID != 0 {
+		t.Fatal("stored a model without a token")
+	}
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/v1/models/"+InhibitorTest.IpfsCid, nil))
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Fatalf("expected 401 without a token, got %d", rec.Code)
+	}
+	token, err := s.Store.Tokens.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec = svg(s, token); rec.Code != http.StatusFound {
+		t.Fatalf("expected redirect after storing, got %d", rec.Code)
+	}
+	if s.Store.Model.GetByCid(InhibitorTest.IpfsCid).ID == 0 {
+		t.Fatal("expected model to be stored with a valid token")
+	}
+	if rec = svg(s, ""); rec.Code != http.StatusFound {
+		t.Fatalf("expected stored models to redirect without a token, got %d", rec.Code)
+	}
+
+	// the server.Service hooks have no request, so they cannot carry a token either
+	if _, ok := s.CheckForModel("localhost", "/p/?z="+TicTacToe.Base64Zipped, ""); ok || s.Store.Model.GetByCid(TicTacToe.IpfsCid).ID != 0 {
+		t.Fatal("CheckForModel stored a model without a token")
+	}
+	source, _ := metamodel.ToEncodedZip([]byte("const declaration = {}"), "declaration.js")
+	if _, ok := s.CheckForSnippet("localhost", "/sandbox/?z="+source, ""); ok {
+		t.Fatal("CheckForSnippet stored a snippet without a token")
+	}
+	recorded := func() int {
+		events, _ := s.Store.Events.Query(storage.EventQuery{})
+		return len(events)
+	}
+	before := recorded()
+	s.Event("modelViewed", map[string]interface{}{"cid": InhibitorTest.IpfsCid})
+	for _, url := range []string{"/img/" + InhibitorTest.IpfsCid + ".svg", "/img/" + InhibitorTest.IpfsCid + ".png", "/src/" + InhibitorTest.IpfsCid + ".json", "/p/" + InhibitorTest.IpfsCid + "/"} {
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, url, nil))
+	}
+	if n := recorded(); n != before {
+		t.Fatalf("anonymous views recorded %d events", n-before)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/img/"+InhibitorTest.IpfsCid+".svg", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	s.stopViews()
+	if n := recorded(); n != before+1 {
+		t.Fatalf("expected a view with a token to be recorded, got %d events", n-before)
+	}
+}
+
+func zipped(t *testing.T, name string, content []byte) string {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	f, err := zw.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write(content)
+	_ = zw.Close()
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestIngestLimits(t *testing.T) {
+	s := newTestServer(t, Options{IngestRate: 1, IngestBurst: 3, MaxZippedBytes: 64 << 10, MaxUnzippedBytes: 1 << 20})
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	bomb := zipped(t, "model.json", make([]byte, 16<<20))
+	if len(bomb) > 64<<10 {
+		t.Fatalf("bomb should compress below the zipped limit, is %d bytes", len(bomb))
+	}
+	if rec := get("/src/?z=" + bomb); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for a zip bomb, got %d", rec.Code)
+	}
+	// UnzipUrl reads the last z=, a valid first one must not smuggle the bomb past the checks
+	if rec := get("/src/?z=" + InhibitorTest.Base64Zipped + "&z=" + bomb); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for repeated z= parameters, got %d", rec.Code)
+	}
+	if rec := get("/src/?z=" + InhibitorTest.Base64Zipped); rec.Code != http.StatusFound {
+		t.Fatalf("expected a valid model to be stored, got %d", rec.Code)
+	}
+	rec := get("/img/?z=" + InhibitorTest.Base64Zipped)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 429 after the burst, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec = get("/img/" + InhibitorTest.IpfsCid + ".svg"); rec.Code != http.StatusOK {
+		t.Fatalf("requests without a payload must not be limited, got %d", rec.Code)
+	}
+
+	stats := s.IngestStats()
+	if stats.Accepted != 1 || stats.TooLarge != 1 || stats.Invalid != 1 || stats.RateLimited != 1 || stats.Clients != 1 {
+		t.Fatalf("unexpected counters: %+v", stats)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	s := newTestServer(t, Options{})
+	buf := new(bytes.Buffer)
+	s.Logger = NewLogger(buf, LogFormatJson, slog.LevelInfo)
+	cid, _ := s.CheckForModel("localhost", "/p/?z="+InhibitorTest.Base64Zipped, "")
+
+	for _, url := range []string{"/img/" + cid + ".svg", "/missing"} {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Referer", "https://example.com/")
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	records := map[string]map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		rec := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("expected json records: %v %s", err, line)
+		}
+		if rec["msg"] == "request" {
+			records[rec["path"].(string)] = rec
+		}
+	}
+	img := records["/img/"+cid+".svg"]
+	if img["route"] != "/img/{pflowCid}.svg" || img["cid"] != cid || img["status"] != float64(200) || img["referrer"] != "https://example.com/" {
+		t.Fatalf("unexpected access record: %v", img)
+	}
+	if missing := records["/missing"]; missing["status"] != float64(404) || missing["route"] != "" {
+		t.Fatalf("unexpected access record for unmatched route: %v", missing)
+	}
+	if !strings.Contains(buf.String(), `"msg":"event","type":"modelUnzipped","params":{"cid":"`+cid) {
+		t.Fatalf("expected structured event record: %s", buf.String())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t, Options{Metrics: true, CacheEntries: 16})
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+	get("/src/?z=" + InhibitorTest.Base64Zipped)
+	get("/src/?z=" + InhibitorTest.Base64Zipped)
+	get("/src/?z=bm90IGEgemlw")
+	get("/img/" + InhibitorTest.IpfsCid + ".svg")
+
+	rec := get("/metrics")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("metrics: %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		`pflow_http_requests_total{route="/src/",method="GET",status="302"} 2`,
+		`pflow_http_requests_total{route="/img/{pflowCid}.svg",method="GET",status="200"} 1`,
+		`pflow_http_request_duration_seconds_count{route="/src/"} 3`,
+		`pflow_blobs_created_total{kind="model"} 1`,
+		`pflow_blob_duplicates_total{kind="model"} 1`,
+		`pflow_ingest_rejected_total{reason="invalid"} 1`,
+		`pflow_sqlite_query_duration_seconds_count{table="pflow_models",op="create"} 2`,
+		`pflow_cache_hits_total{cache="models"}`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("missing %s", line)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
+
+// vendoredSandbox writes stand-ins for the sandbox assets and pins their hashes until the test ends
+func vendoredSandbox(t *testing.T) http.Dir {
+	dir := t.TempDir()
+	pinned := sandbox.Assets
+	t.Cleanup(func() { sandbox.Assets = pinned })
+	sandbox.Assets = make([]sandbox.Asset, len(pinned))
+	for i, a := range pinned {
+		data := []byte("/* " + a.Name + " */")
+		a.Integrity = sandbox.Integrity(data)
+		sandbox.Assets[i] = a
+		target := filepath.Join(dir, filepath.FromSlash(a.Name))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(target, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return http.Dir(dir)
+}
+
+// editorAssets writes a stand-in editor build with the asset manifest create-react-app generates
+func editorAssets(t *testing.T) http.Dir {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"p/asset-manifest.json":      `{"files":{"main.js":"/p/static/js/main.1a2b.js"},"entrypoints":["static/css/main.3c4d.css","static/js/main.1a2b.js"]}`,
+		"p/static/js/main.1a2b.js":   "render()",
+		"p/static/css/main.3c4d.css": "body {}",
+	} {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(target, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return http.Dir(dir)
+}
+
+func loadEditor(t *testing.T, s *Server) {
+	if err := s.LoadEditorAssets(editorAssets(t)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	s := newTestServer(t, Options{UseSandbox: true})
+	probe := func(path string) (int, HealthReport) {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		report := HealthReport{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatalf("%s: %v %s", path, err, rec.Body)
+		}
+		return rec.Code, report
+	}
+	failed := func(report HealthReport) []string {
+		names := []string{}
+		for _, check := range report.Checks {
+			if !check.Ok {
+				names = append(names, check.Name)
+			}
+		}
+		return names
+	}
+
+	if code, report := probe(healthzPath); code != http.StatusOK || report.Status != "ok" {
+		t.Fatalf("healthz: %d %+v", code, report)
+	}
+	code, report := probe(readyzPath)
+	if code != http.StatusServiceUnavailable || strings.Join(failed(report), ",") != "static,sandbox" || len(report.Checks) != 4 {
+		t.Fatalf("expected static and sandbox to fail before assets are loaded: %d %+v", code, report)
+	}
+	s.Static = http.NotFoundHandler()
+	if err := s.LoadSandboxAssets(vendoredSandbox(t)); err != nil {
+		t.Fatal(err)
+	}
+	if code, report = probe(readyzPath); code != http.StatusOK || report.Status != "ok" {
+		t.Fatalf("readyz: %d %+v", code, report)
+	}
+
+	_ = s.Store.Close()
+	code, report = probe(readyzPath)
+	if code != http.StatusServiceUnavailable || strings.Join(failed(report), ",") != "database,tables" {
+		t.Fatalf("expected database checks to fail once the store is closed: %d %+v", code, report)
+	}
+	if code, _ = probe(healthzPath); code != http.StatusOK {
+		t.Fatalf("healthz should not depend on the database: %d", code)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	s := newTestServer(t, Options{WebhookAttempts: 2, WebhookBackoff: 10 * time.Millisecond, WebhookTimeout: time.Second})
+	type received struct {
+		attempt   int
+		event     string
+		signature string
+		body      []byte
+	}
+	requests := make(chan received, 16)
+	var attempts atomic.Int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempt := int(attempts.Add(1))
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{attempt, r.Header.Get("X-Pflow-Event"), r.Header.Get(SignatureHeader), body}
+		if attempt == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer flaky.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	flakyHook, err := s.Store.Webhooks.Create(flaky.URL, []string{"modelUnzipped"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	downHook, _ := s.Store.Webhooks.Create(down.URL, nil)
+	deletedHook, _ := s.Store.Webhooks.Create(flaky.URL, []string{"modelDeleted"})
+	s.startWebhooks()
+	defer s.stopWebhooks()
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/p/?z="+InhibitorTest.Base64Zipped, nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("expected redirect, got %d", rec.Code)
+	}
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		select {
+		case got := <-requests:
+			if got.attempt != attempt || got.event != "modelUnzipped" {
+				t.Fatalf("unexpected delivery %+v", got)
+			}
+			if !hmac.Equal([]byte(got.signature), []byte(Sign(flakyHook.Secret, got.body))) {
+				t.Fatalf("bad signature %s", got.signature)
+			}
+			evt := storage.Event{}
+			if err := json.Unmarshal(got.body, &evt); err != nil || evt.Params["cid"] != InhibitorTest.IpfsCid {
+				t.Fatalf("unexpected payload %s", got.body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("attempt %d was not delivered", attempt)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dead, _ := s.Store.Webhooks.Deliveries(storage.DeliveryQuery{WebhookID: downHook.ID, Status: storage.DeliveryDead})
+		delivered, _ := s.Store.Webhooks.Deliveries(storage.DeliveryQuery{WebhookID: flakyHook.ID, Status: storage.DeliveryDelivered})
+		if len(dead) == 1 && dead[0].Attempts == 2 && dead[0].ResponseCode == http.StatusServiceUnavailable &&
+			len(delivered) == 1 && delivered[0].Attempts == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one delivered and one dead-lettered delivery, got %+v %+v", delivered, dead)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if skipped, _ := s.Store.Webhooks.Deliveries(storage.DeliveryQuery{WebhookID: deletedHook.ID}); len(skipped) != 0 {
+		t.Fatalf("webhook was not subscribed to the event: %+v", skipped)
+	}
+}
+
+func TestValidateWebhook(t *testing.T) {
+	for _, tc := range []struct {
+		url    string
+		events []string
+		valid  bool
+	}{
+		{"https://ci.example.com/pflow", []string{"modelUnzipped", "modelDeleted"}, true},
+		{"http://localhost:8080/hook", nil, true},
+		{"ci.example.com/pflow", nil, false},
+		{"ftp://ci.example.com/pflow", nil, false},
+		{"https:///pflow", nil, false},
+		{"https://ci.example.com/pflow", []string{"modelUnziped"}, false},
+	} {
+		if err := ValidateWebhook(tc.url, tc.events); (err == nil) != tc.valid {
+			t.Errorf("%s %v: expected valid=%v, got %v", tc.url, tc.events, tc.valid, err)
+		}
+	}
+	if d := newWebhookDispatcher(0); d.client.Timeout != defaultWebhookTimeout {
+		t.Fatalf("expected the default timeout, got %v", d.client.Timeout)
+	}
+}
+
+func TestViewEvents(t *testing.T) {
+	s := newTestServer(t, Options{CacheEntries: 16})
+	cid, ok := s.CheckForModel("localhost", "/p/?z="+InhibitorTest.Base64Zipped, "")
+	if !ok {
+		t.Fatal("failed to store model")
+	}
+	var appends atomic.Int64
+	s.Store.ObserveQueries(func(table, op string, _ time.Duration) {
+		if op == "append" {
+			appends.Add(1)
+		}
+	})
+	const views = 200
+	var wg sync.WaitGroup
+	for i := 0; i < views; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/img/"+cid+".svg", nil))
+		}()
+	}
+	wg.Wait()
+	s.stopViews()
+	events, _ := s.Store.Events.Query(storage.EventQuery{Type: "svgRendered"})
+	if len(events)+int(s.views.dropped.Load()) != views || len(events) == 0 {
+		t.Fatalf("expected %d views, got %d recorded and %d dropped", views, len(events), s.views.dropped.Load())
+	}
+	if n := appends.Load(); n >= views {
+		t.Fatalf("expected views to be written in batches, got %d appends for %d views", n, views)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	s := newTestServer(t, Options{MaxSessions: 4, SessionIdle: time.Minute})
+	if _, ok := s.CheckForModel("localhost", "/p/?z="+InhibitorTest.Base64Zipped, ""); !ok {
+		t.Fatal("failed to store model")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.httpServer.Serve(ln) }()
+	base := "http://" + ln.Addr().String()
+	post := func(url, body string) (int, map[string]interface{}) {
+		res, err := http.Post(base+url, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		out := map[string]interface{}{}
+		_ = json.NewDecoder(res.Body).Decode(&out)
+		return res.StatusCode, out
+	}
+
+	code, created := post(sessionsPath, `{"cid": "`+InhibitorTest.IpfsCid+`"}`)
+	if code != http.StatusCreated || created["tokens"].(map[string]interface{})["foo"] != 1.0 {
+		t.Fatalf("create: %d %v", code, created)
+	}
+	id := created["session"].(string)
+	if code, _ = post(sessionsPath, `{"cid": "unknown"}`); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown model, got %d", code)
+	}
+
+	// subscribe reads state events from an event stream
+	subscribe := func() chan string {
+		res, err := http.Get(base + sessionsPath + "/" + id + "/events")
+		if err != nil || res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("subscribe: %v %v", err, res)
+		}
+		events := make(chan string, 8)
+		go func() {
+			defer res.Body.Close()
+			defer close(events)
+			scanner := bufio.NewScanner(res.Body)
+			event := ""
+			for scanner.Scan() {
+				line := scanner.Text()
+				if line == "" {
+					events <- event
+					event = ""
+				} else if !strings.HasPrefix(line, ":") {
+					event += line + "\n"
+				}
+			}
+		}()
+		return events
+	}
+	next := func(events chan string) string {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+			return ""
+		}
+	}
+	first, second := subscribe(), subscribe()
+	for _, events := range []chan string{first, second} {
+		if event := next(events); !strings.HasPrefix(event, "id: 0\nevent: state\n") {
+			t.Fatalf("expected the current state first, got %q", event)
+		}
+	}
+
+	if code, _ = post(sessionsPath+"/"+id+"/fire", `{"action": "dec"}`); code != http.StatusOK {
+		t.Fatalf("fire: %d", code)
+	}
+	for _, events := range []chan string{first, second} {
+		if event := next(events); !strings.Contains(event, `"action":"dec"`) || !strings.Contains(event, `"tokens":{"foo":0}`) {
+			t.Fatalf("expected the fired state, got %q", event)
+		}
+	}
+	if code, body := post(sessionsPath+"/"+id+"/fire", `{"action": "dec"}`); code != http.StatusConflict {
+		t.Fatalf("expected 409 on underflow, got %d %v", code, body)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, base+sessionsPath+"/"+id, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: %v %v", err, res)
+	}
+	if event := next(first); !strings.HasPrefix(event, "event: end\n") {
+		t.Fatalf("expected an end event, got %q", event)
+	}
+
+	// open streams must not hold shutdown open
+	if code, created = post(sessionsPath, `{"cid": "`+InhibitorTest.IpfsCid+`"}`); code != http.StatusCreated {
+		t.Fatalf("create: %d %v", code, created)
+	}
+	id = created["session"].(string)
+	next(subscribe())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	s := newTestServer(t, Options{TrustProxy: true, IngestRate: 1, IngestBurst: 1})
+	get := func(forwardedFor ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/src/?z="+InhibitorTest.Base64Zipped, nil)
+		for _, v := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := get("198.51.100.1, 203.0.113.7"); rec.Code != http.StatusFound {
+		t.Fatalf("expected the first request to pass, got %d", rec.Code)
+	}
+	// the proxy appends the real client, a spoofed leftmost entry must not get a fresh bucket
+	if rec := get("198.51.100.2, 203.0.113.7"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the spoofed address to share the bucket, got %d", rec.Code)
+	}
+	if rec := get("198.51.100.3", "203.0.113.7"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected repeated headers to be read from the right, got %d", rec.Code)
+	}
+	if clients := s.IngestStats().Clients; clients != 1 {
+		t.Fatalf("expected one client, got %d", clients)
+	}
+
+	s.Options.ProxyHops = 2
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-For", "198.51.100.9, 203.0.113.7, 192.0.2.1")
+	if ip := forwardedFor(req, s.Options.ProxyHops); ip != "203.0.113.7" {
+		t.Fatalf("expected the address before the last trusted hop, got %s", ip)
+	}
+	if ip := forwardedFor(req, 4); ip != "" {
+		t.Fatalf("expected no address with fewer entries than hops, got %s", ip)
+	}
+}
+
+func TestBaseUrl(t *testing.T) {
+	lastLink := func(s *Server) string {
+		events, _ := s.Store.Events.Query(storage.EventQuery{Type: "modelUnzipped", Limit: 1, Newest: true})
+		if len(events) != 1 {
+			t.Fatal("expected a modelUnzipped event")
+		}
+		return events[0].Params["link"].(string)
+	}
+	get := func(s *Server, url string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+	cid := InhibitorTest.IpfsCid
+	proxied := map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "tools.example.com"}
+
+	s := newTestServer(t, Options{Url: "https://tools.example.com/tools/pflow/", TrustProxy: true})
+	loadEditor(t, s)
+	rec := get(s, "/tools/pflow/p/?z="+InhibitorTest.Base64Zipped, proxied)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/tools/pflow/p/"+cid+"/" {
+		t.Fatalf("expected redirect under the sub-path, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	if link := lastLink(s); link != "https://tools.example.com/tools/pflow/p/"+cid+"/" {
+		t.Fatalf("unexpected link %s", link)
+	}
+	// a proxy that strips the prefix reaches the same routes
+	rec = get(s, "/p/"+cid+"/", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `href="/tools/pflow/p/static/css/`) {
+		t.Fatalf("expected assets under the sub-path, got %d %s", rec.Code, rec.Body)
+	}
+	rec = get(s, "/src/?z="+InhibitorTest.Base64Zipped, map[string]string{"X-Forwarded-Prefix": "/other/"})
+	if rec.Header().Get("Location") != "/other/src/"+cid+".json" {
+		t.Fatalf("expected X-Forwarded-Prefix in the redirect, got %s", rec.Header().Get("Location"))
+	}
+
+	untrusted := newTestServer(t, Options{Url: "http://localhost:8083"})
+	get(untrusted, "/p/?z="+InhibitorTest.Base64Zipped, proxied)
+	if link := lastLink(untrusted); link != "http://example.com/p/"+cid+"/" {
+		t.Fatalf("forwarded headers must be ignored unless the proxy is trusted, got %s", link)
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	s := newTestServer(t, Options{Url: "http://localhost:8083"})
+	loadEditor(t, s)
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+	cid, ok := s.CheckForModel("localhost", "/p/?z="+InhibitorTest.Base64Zipped, "")
+	if !ok {
+		t.Fatal("failed to store model")
+	}
+
+	rec := get("/embed/" + cid + "?controls=1&theme=dark&state=[1,0,0]")
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Frame-Options") != "" {
+		t.Fatalf("expected a frameable page, got %d %v", rec.Code, rec.Header())
+	}
+	for _, want := range []string{`src="/img/` + cid + `.svg?state=%5b1%2c0%2c0%5d"`, `data-action="dec"`, "invert(1)", "/api/sessions"} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %s in embed page\n%s", want, body)
+		}
+	}
+	if body := get("/embed/" + cid).Body.String(); strings.Contains(body, "<button") || strings.Contains(body, "?state=") {
+		t.Fatalf("controls and state are opt in\n%s", body)
+	}
+	if rec := get("/embed/unknown"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 got %d", rec.Code)
+	}
+
+	page := "http://example.com/p/" + cid + "/"
+	rec = get("/oembed?maxwidth=200&url=" + page)
+	res := oembedResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("expected oembed json, got %d %s", rec.Code, rec.Body)
+	}
+	if res.Version != "1.0" || res.Type != "rich" || res.Width != 200 || res.Height <= 0 ||
+		!strings.Contains(res.Html, `src="http://example.com/embed/`+cid+`?controls=1"`) ||
+		res.ThumbnailUrl != "http://example.com/img/"+cid+".svg" {
+		t.Fatalf("unexpected oembed response %+v", res)
+	}
+	if !strings.Contains(get("/p/"+cid+"/").Body.String(), `type="application/json+oembed"`) {
+		t.Fatal("expected oembed discovery link on the model page")
+	}
+	for url, status := range map[string]int{
+		"/oembed?url=http://example.com/src/" + cid + ".json": http.StatusNotFound,
+		"/oembed?url=" + page + "&format=xml":                 http.StatusNotImplemented,
+		"/oembed":                                             http.StatusBadRequest,
+	} {
+		if rec := get(url); rec.Code != status {
+			t.Fatalf("%s: expected %d got %d", url, status, rec.Code)
+		}
+	}
+
+	private := storePrivate(t, s, sealed.NewSecret())
+	if rec := get("/embed/" + private); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("private models cannot be embedded, got %d", rec.Code)
+	}
+	if rec := get("/oembed?url=http://example.com/p/" + private + "/"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("private models cannot be embedded, got %d", rec.Code)
+	}
+}
+
+func TestPng(t *testing.T) {
+	s := newTestServer(t, Options{CacheEntries: 16})
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+	cid, ok := s.CheckForModel("localhost", "/p/?z="+InhibitorTest.Base64Zipped, "")
+	if !ok {
+		t.Fatal("failed to store model")
+	}
+	svg := get("/img/" + cid + ".svg?state=[0]")
+	entries := s.renderCache.Stats().Entries
+	if same := get("/img/" + cid + ".svg?state=[%200%20]"); same.Body.String() != svg.Body.String() || s.renderCache.Stats().Entries != entries {
+		t.Fatal("expected equivalent svg states to share a cache entry")
+	}
+	rec := get("/img/" + cid + ".png?width=110&scale=2&state=[0]")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("expected png, got %d %s", rec.Code, rec.Body)
+	}
+	img, err := png.Decode(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 220 || b.Dy() != 220 {
+		t.Fatalf("expected 220x220, got %v", b)
+	}
+	if again := get("/img/" + cid + ".png?width=110&scale=2&state=[0]"); !bytes.Equal(again.Body.Bytes(), rec.Body.Bytes()) {
+		t.Fatal("expected the cached image")
+	}
+	entries = s.renderCache.Stats().Entries
+	if same := get("/img/" + cid + ".png?state=[%200%20]&scale=2.0&width=110&background=fff"); !bytes.Equal(same.Body.Bytes(), rec.Body.Bytes()) {
+		t.Fatal("expected an equivalent query to be served from the cache")
+	}
+	if n := s.renderCache.Stats().Entries; n != entries {
+		t.Fatalf("expected equivalent queries to share a cache entry, got %d entries", n)
+	}
+	for i := 0; i < cap(s.pngSlots); i++ {
+		s.pngSlots <- struct{}{}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	busy := httptest.NewRecorder()
+	s.ServeHTTP(busy, httptest.NewRequest(http.MethodGet, "/img/"+cid+".png?width=64", nil).WithContext(ctx))
+	cancel()
+	for i := 0; i < cap(s.pngSlots); i++ {
+		<-s.pngSlots
+	}
+	if busy.Body.Len() != 0 || s.renderCache.Stats().Entries != entries {
+		t.Fatalf("expected a request that gave up waiting for a slot to render and cache nothing, got %d bytes", busy.Body.Len())
+	}
+	if png64, _ := png.Decode(get("/img/" + cid + ".png?width=64").Body); png64 == nil {
+		t.Fatal("expected the abandoned render to be retried")
+	}
+	if transparent, _ := png.Decode(get("/img/" + cid + ".png?background=transparent").Body); transparent == nil {
+		t.Fatal("expected a transparent png")
+	} else if _, _, _, a := transparent.At(0, 0).RGBA(); a != 0 {
+		t.Fatalf("expected a transparent corner, got alpha %d", a)
+	}
+	for url, status := range map[string]int{
+		"/img/" + cid + ".png?scale=10":        http.StatusBadRequest,
+		"/img/" + cid + ".png?width=0":         http.StatusBadRequest,
+		"/img/" + cid + ".png?background=blue": http.StatusBadRequest,
+		"/img/unknown.png":                     http.StatusNotFound,
+	} {
+		if rec := get(url); rec.Code != status {
+			t.Fatalf("%s: expected %d got %d", url, status, rec.Code)
+		}
+	}
+}
+
+func TestPageMeta(t *testing.T) {
+	s := newTestServer(t, Options{Url: "http://localhost:8083"})
+	loadEditor(t, s)
+	get := func(url string) string {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec.Body.String()
+	}
+	cid, ok := s.CheckForModel("localhost", "/p/?z="+InhibitorTest.Base64Zipped, "")
+	if !ok {
+		t.Fatal("failed to store model")
+	}
+	if _, err := s.Store.Model.Update(cid, `Counter "<b>"`, "counts up & down", ""); err != nil {
+		t.Fatal(err)
+	}
+	page := get("/p/" + cid + "/")
+	for _, want := range []string{
+		`<title>Counter &#34;&lt;b&gt;&#34; | pflow</title>`,
+		`<meta name="description" content="counts up &amp; down"/>`,
+		`<link rel="canonical" href="http://example.com/p/` + cid + `/"/>`,
+		`<meta property="og:title" content="Counter &#34;&lt;b&gt;&#34;"/>`,
+		`<meta property="og:image" content="http://example.com/img/` + cid + `.png?width=1200&amp;height=630"/>`,
+		`<meta name="twitter:card" content="summary_large_image"/>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Fatalf("expected %s in\n%s", want, page)
+		}
+	}
+
+	if blank := get("/p/"); strings.Contains(blank, "og:") || !strings.Contains(blank, "<title>pflow | metamodel explorer</title>") {
+		t.Fatalf("pages without a stored model keep the generic metadata\n%s", blank)
+	}
+}
+
+func TestSandboxAssets(t *testing.T) {
+	s := newTestServer(t, Options{UseSandbox: true, Url: "http://localhost:8083/tools/"})
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+	if rec := get("/tools/sandbox/"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before the assets are verified, got %d", rec.Code)
+	}
+	assets := vendoredSandbox(t)
+	if err := s.LoadSandboxAssets(assets); err != nil {
+		t.Fatal(err)
+	}
+
+	page := get("/tools/sandbox/").Body.String()
+	if strings.Contains(page, "https://") && !strings.Contains(page, "https://pflow.dev/") {
+		t.Fatalf("expected no external assets\n%s", page)
+	}
+	for _, a := range sandbox.Assets {
+		if !strings.HasSuffix(a.Name, ".js") && !strings.HasSuffix(a.Name, ".css") || strings.HasPrefix(a.Name, "ace/") && a.Name != "ace/ace.js" {
+			continue
+		}
+		want := `"/tools/sandbox/static/` + a.Name + `" integrity="` + strings.ReplaceAll(sandbox.Integrity([]byte("/* "+a.Name+" */")), "+", "&#43;") + `"`
+		if !strings.Contains(page, want) {
+			t.Fatalf("expected %s in the sandbox page\n%s", want, page)
+		}
+	}
+	rec := get("/tools/sandbox/static/ace/mode-javascript.js")
+	if rec.Code != http.StatusOK || rec.Body.String() != "/* ace/mode-javascript.js */" || rec.Header().Get("Cache-Control") == "" {
+		t.Fatalf("expected the vendored asset, got %d %s", rec.Code, rec.Body)
+	}
+	for _, path := range []string{"/sandbox/static/integrity.json", "/sandbox/static/ace/", "/sandbox/static/missing.js"} {
+		if rec := get(path); rec.Code != http.StatusNotFound {
+			t.Fatalf("%s: expected 404 got %d", path, rec.Code)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(string(assets), "jszip.min.js"), []byte("alert(1)"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestServer(t, Options{UseSandbox: true}).LoadSandboxAssets(assets); err == nil {
+		t.Fatal("expected a tampered asset to fail verification")
+	}
+}
+
+func TestEditorAssets(t *testing.T) {
+	s := newTestServer(t, Options{})
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+	if rec := get("/p/"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before the editor build is loaded, got %d", rec.Code)
+	}
+	if err := s.LoadEditorAssets(http.Dir(t.TempDir())); err == nil || !strings.Contains(err.Error(), "/p/asset-manifest.json is missing") {
+		t.Fatalf("expected a missing manifest to fail, got %v", err)
+	}
+
+	dir := editorAssets(t)
+	version := filepath.Join(string(dir), "p", "v", "next")
+	if err := os.MkdirAll(version, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	err := os.WriteFile(filepath.Join(version, assetManifest), []byte(`{"entrypoints":["static/js/main.5e6f.js"]}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.LoadEditorAssets(dir); err != nil {
+		t.Fatal(err)
+	}
+	page := get("/p/").Body.String()
+	for _, want := range []string{
+		`<link href="/p/static/css/main.3c4d.css" rel="stylesheet">`,
+		`<script defer="defer" src="/p/static/js/main.1a2b.js"></script>`,
+		`<link rel="manifest" href="/p/manifest.json"/>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Fatalf("expected %s in\n%s", want, page)
+		}
+	}
+	page = get("/p/?editor=next").Body.String()
+	if !strings.Contains(page, `src="/p/v/next/static/js/main.5e6f.js"`) || strings.Contains(page, "main.1a2b.js") {
+		t.Fatalf("expected the versioned build\n%s", page)
+	}
+	if rec := get("/p/?editor=missing"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown version, got %d", rec.Code)
+	}
+	if rec := get("/p/static/js/main.1a2b.js"); rec.Code != http.StatusOK || rec.Body.String() != "render()" {
+		t.Fatalf("expected the editor script, got %d %s", rec.Code, rec.Body)
+	}
+
+	err = os.WriteFile(filepath.Join(version, assetManifest), []byte(`{"entrypoints":["../../static/js/main.1a2b.js"]}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.LoadEditorAssets(dir); err == nil {
+		t.Fatal("expected an entrypoint outside the build to fail")
+	}
+}
+
+func TestDevMode(t *testing.T) {
+	dir := filepath.Join(string(editorAssets(t)), "p")
+	s := newTestServer(t, Options{EditorDir: dir})
+	if err := s.LoadEditorAssets(EditorDir(dir)); err != nil {
+		t.Fatal(err)
+	}
+	go s.watchEditor(dir, 10*time.Millisecond)
+	ts := httptest.NewServer(s)
+	t.Cleanup(func() {
+		s.dev.Close()
+		ts.Close()
+	})
+
+	res, err := http.Get(ts.URL + "/p/static/js/main.1a2b.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("expected an uncached asset from disk, got %d %v", res.StatusCode, res.Header)
+	}
+	events, err := http.Get(ts.URL + devEventsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Body.Close()
+
+	err = os.WriteFile(filepath.Join(dir, "static", "js", "main.9f8e.js"), []byte("render(2)"), 0o644)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, assetManifest), []byte(`{"entrypoints":["static/js/main.9f8e.js"]}`), 0o644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan bool, 1)
+	go func() {
+		lines := bufio.NewScanner(events.Body)
+		for lines.Scan() {
+			if lines.Text() == "event: reload" {
+				reloaded <- true
+				return
+			}
+		}
+		reloaded <- false
+	}()
+	select {
+	case ok := <-reloaded:
+		if !ok {
+			t.Fatal("event stream ended without a reload")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a reload event after the build changed")
+	}
+
+	res, err = http.Get(ts.URL + "/p/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	page := string(body)
+	if res.Header.Get("Cache-Control") != "no-store" || !strings.Contains(page, `src="/p/static/js/main.9f8e.js"`) ||
+		!strings.Contains(page, `new EventSource("/api/dev/events")`) {
+		t.Fatalf("expected the new build with live reload, got %v\n%s", res.Header, page)
+	}
+}
+
+func TestSnippetRender(t *testing.T) {
+	s := newTestServer(t, Options{CacheEntries: 16, SnippetTimeout: 50 * time.Millisecond})
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+	store := func(source string) string {
+		zipped, _ := metamodel.ToEncodedZip([]byte(source), "declaration.js")
+		cid, ok := s.CheckForSnippet("localhost", "/sandbox/?z="+zipped, "")
+		if !ok {
+			t.Fatal("failed to store snippet")
+		}
+		return cid
+	}
+	cid := store(`function declaration({fn, cell, role}) {
+		const foo = cell("foo", 1, 3, {x: 250, y: 250});
+		fn("inc", role("default"), {x: 200, y: 200}).tx(1, foo);
+	}`)
+	for url, contentType := range map[string]string{
+		"/img/" + cid + ".svg":  "image/svg+xml",
+		"/img/" + cid + ".png":  "image/png",
+		"/src/" + cid + ".json": "application/javascript",
+	} {
+		rec := get(url)
+		if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), contentType) {
+			t.Fatalf("%s: %d %s", url, rec.Code, rec.Body)
+		}
+	}
+	decl := metamodel.DeclarationObject{}
+	if err := json.Unmarshal(get("/src/"+cid+".json").Body.Bytes(), &decl); err != nil || decl.Places["foo"].Capacity != 3 {
+		t.Fatalf("expected the declared model, got %+v %v", decl, err)
+	}
+
+	looping := store("function declaration() { while (true) {} }")
+	rec := get("/img/" + looping + ".svg")
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "timed out") {
+		t.Fatalf("expected the snippet to time out, got %d %s", rec.Code, rec.Body)
+	}
+	start := time.Now()
+	if rec = get("/src/" + looping + ".json"); rec.Code != http.StatusUnprocessableEntity || time.Since(start) >= 50*time.Millisecond {
+		t.Fatalf("expected the cached timeout, got %d after %v", rec.Code, time.Since(start))
+	}
+	if rec = get("/src/" + store("const notDeclared = 1") + ".json"); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected a snippet without a declaration to fail, got %d", rec.Code)
+	}
+}
+
+func TestSnippetRateLimit(t *testing.T) {
+	s := newTestServer(t, Options{CacheEntries: 16, IngestRate: 0.01, IngestBurst: 1})
+	get := func(url string) int {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec.Code
+	}
+	cids := []string{}
+	for _, source := range []string{"const declaration = {places: {}}", "const declaration = {transitions: {}}"} {
+		zipped, _ := metamodel.ToEncodedZip([]byte(source), "declaration.js")
+		cid, ok := s.CheckForSnippet("localhost", "/sandbox/?z="+zipped, "")
+		if !ok {
+			t.Fatal("failed to store snippet")
+		}
+		cids = append(cids, cid)
+	}
+	if code := get("/src/" + cids[0] + ".json"); code != http.StatusOK {
+		t.Fatalf("expected the first evaluation to be allowed, got %d", code)
+	}
+	if code := get("/src/" + cids[0] + ".json"); code != http.StatusOK {
+		t.Fatalf("expected a cached result to skip the rate limit, got %d", code)
+	}
+	if code := get("/src/" + cids[1] + ".json"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected evaluations to be rate limited, got %d", code)
+	}
+}
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"github.com/pflow-dev/go-metamodel/v2/metamodel"
+	"github.com/pflow-dev/go-metamodel/v2/model"
+	"github.com/pflow-dev/pflow-cli/sandbox"
+	"net/http"
+	"strings"
+)
+
+const (
+	bearerScheme   = "Bearer"
+	apiTokenHeader = "X-Api-Token"
+)
+
+// apiToken reads `Authorization: Bearer <token>`
+// X-Api-Token is accepted as well for requests that use Authorization for a share secret
+func apiToken(r *http.Request) (string, bool) {
+	if token := r.Header.Get(apiTokenHeader); token != "" {
+		return token, true
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, bearerScheme) || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// anonymousWrite reports whether requests without a token may insert rows
+func (s *Server) anonymousWrite() bool {
+	return !s.Options.ReadOnly && !s.Options.RequireToken
+}
+
+// canWrite reports whether r may insert or change rows
+func (s *Server) canWrite(r *http.Request) bool {
+	if s.Options.ReadOnly {
+		return false
+	}
+	if !s.Options.RequireToken {
+		return true
+	}
+	token, ok := apiToken(r)
+	return ok && s.Store.Tokens.Valid(token)
+}
+
+// requireWrite rejects api writes on a read-only server or without a valid token
+func (s *Server) requireWrite(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Options.ReadOnly {
+			apiFail(w, http.StatusForbidden, "server is read-only")
+			return
+		}
+		if s.Options.RequireToken {
+			token, ok := apiToken(r)
+			if !ok || !s.Store.Tokens.Valid(token) {
+				w.Header().Set("WWW-Authenticate", bearerScheme)
+				apiFail(w, http.StatusUnauthorized, "a valid api token is required")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// urlModel returns a ?z= model that was not stored so it can still be rendered
+func (s *Server) urlModel(r *http.Request) (*model.Zblob, bool) {
+	_, zippedData, ok := s.modelFromUrl(r.URL.String())
+	if !ok {
+		return nil, false
+	}
+	return &model.Zblob{Base64Zipped: zippedData}, true
+}
+
+// checkForSnippet stores a ?z= snippet when r is allowed to write, otherwise it only finds stored snippets
+func (s *Server) checkForSnippet(r *http.Request) (string, bool) {
+	return s.storeSnippet(s.baseUrl(r), r.URL.String(), r.Header.Get("Referer"), s.canWrite(r))
+}
+
+// SandboxHandler serves the snippet sandbox, a ?z= snippet that cannot be stored is shown without a cid
+func (s *Server) SandboxHandler(vars map[string]string, w http.ResponseWriter, r *http.Request) {
+	cid, found := s.checkForSnippet(r)
+	if found {
+		http.Redirect(w, r, link(r, "/sandbox/"+cid+"/"), http.StatusFound)
+		return
+	}
+	if s.sandboxHashes == nil {
+		http.Error(w, "sandbox assets are not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	templateData := struct {
+		IpfsCid    string
+		SourceCode string
+		Base       string
+		Integrity  sandbox.Manifest
+	}{
+		IpfsCid:   vars["pflowCid"],
+		Base:      link(r, ""),
+		Integrity: s.sandboxHashes,
+	}
+	if vars["pflowCid"] != "" {
+		rec := s.App.Snippet.GetByCid(vars["pflowCid"])
+		templateData.SourceCode, _ = metamodel.UnzipUrl("?z="+rec.Base64Zipped, "declaration.js")
+	} else if _, sourceCode, ok := s.snippetFromUrl(r.URL.String()); ok {
+		templateData.SourceCode = sourceCode
+	}
+	_ = s.SandboxPage().ExecuteTemplate(w, "sandbox.html", templateData)
+}
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type prefixKey struct{}
+
+// basePath is the sub-path the app is mounted under, taken from the path of Options.Url
+func (s *Server) basePath() string {
+	u, err := url.Parse(s.Options.Url)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(u.Path, "/")
+}
+
+// firstHeader returns the first value of a comma separated header set by one or more proxies
+func firstHeader(r *http.Request, name string) string {
+	value, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(value)
+}
+
+// forwardedFor returns the client address appended by the trusted proxies, the entry hops from the right,
+// entries further left are whatever the client sent and cannot be trusted
+func forwardedFor(r *http.Request, hops int) string {
+	if hops < 1 {
+		hops = 1
+	}
+	var entries []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		entries = append(entries, strings.Split(header, ",")...)
+	}
+	if len(entries) < hops {
+		return ""
+	}
+	return strings.TrimSpace(entries[len(entries)-hops])
+}
+
+// mount strips the base path from requests that still carry it, so the proxy may forward either form,
+// and records the prefix links are built with
+// behind a trusted proxy X-Forwarded-Prefix replaces the prefix and X-Forwarded-For the client address
+func (s *Server) mount(next http.Handler) http.Handler {
+	base := s.basePath()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := base
+		if base != "" && (r.URL.Path == base || strings.HasPrefix(r.URL.Path, base+"/")) {
+			r = r.Clone(r.Context())
+			r.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, base), "/")
+			r.URL.RawPath = ""
+		}
+		if s.Options.TrustProxy {
+			if forwarded := strings.TrimRight(firstHeader(r, "X-Forwarded-Prefix"), "/"); forwarded != "" {
+				prefix = forwarded
+			}
+			if ip := forwardedFor(r, s.Options.ProxyHops); net.ParseIP(ip) != nil {
+				r = r.Clone(r.Context())
+				r.RemoteAddr = net.JoinHostPort(ip, "0")
+			}
+		}
+		if prefix != "" {
+			r = r.WithContext(context.WithValue(r.Context(), prefixKey{}, prefix))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// link returns path under the prefix the request was made with, for redirects and Location headers
+func link(r *http.Request, path string) string {
+	prefix, _ := r.Context().Value(prefixKey{}).(string)
+	return prefix + path
+}
+
+// baseUrl is the absolute url of the app as the client sees it, without a trailing slash
+func (s *Server) baseUrl(r *http.Request) string {
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if s.Options.TrustProxy {
+		if proto := firstHeader(r, "X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwarded := firstHeader(r, "X-Forwarded-Host"); forwarded != "" {
+			host = forwarded
+		}
+	}
+	if host == "" {
+		if u, err := url.Parse(s.Options.Url); err == nil {
+			scheme, host = u.Scheme, u.Host
+		}
+	}
+	return scheme + "://" + host + link(r, "")
+}
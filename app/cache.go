@@ -0,0 +1,65 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pflow-dev/go-metamodel/v2/server"
+	"github.com/pflow-dev/pflow-cli/cache"
+	"github.com/pflow-dev/pflow-cli/storage"
+	"io"
+	"net/http"
+)
+
+// newCaches wraps the blob tables with read-through caches and
+// allocates the cache of rendered svg and json documents
+func (s *Server) newCaches(store *storage.Storage) server.Storage {
+	if s.Options.CacheEntries <= 0 {
+		return server.Storage{
+			Model:   store.Model,
+			Snippet: store.Snippet,
+		}
+	}
+	s.modelCache = cache.NewBlobs(store.Model, cache.New(s.Options.CacheEntries, s.Options.CacheBytes))
+	s.snippetCache = cache.NewBlobs(store.Snippet, cache.New(s.Options.CacheEntries, s.Options.CacheBytes))
+	s.renderCache = cache.New(s.Options.CacheEntries, s.Options.CacheBytes)
+	return server.Storage{
+		Model:   s.modelCache,
+		Snippet: s.snippetCache,
+	}
+}
+
+func (s *Server) CacheStats() map[string]cache.Stats {
+	stats := map[string]cache.Stats{}
+	if s.renderCache != nil {
+		stats["models"] = s.modelCache.Stats()
+		stats["snippets"] = s.snippetCache.Stats()
+		stats["renders"] = s.renderCache.Stats()
+	}
+	return stats
+}
+
+func (s *Server) CacheHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(s.CacheStats())
+}
+
+// writeCached serves a previously rendered document or renders and stores it
+// key must identify the output completely, i.e. the cid plus any render options,
+// an empty render, e.g. one abandoned because the client went away, is not stored
+func (s *Server) writeCached(w http.ResponseWriter, key string, contentType string, render func(out io.Writer)) {
+	w.Header().Set("Content-Type", contentType)
+	if s.renderCache == nil {
+		render(w)
+		return
+	}
+	if v, ok := s.renderCache.Get(key); ok {
+		_, _ = w.Write(v.([]byte))
+		return
+	}
+	buf := new(bytes.Buffer)
+	render(buf)
+	if buf.Len() > 0 {
+		s.renderCache.Add(key, buf.Bytes(), int64(len(key)+buf.Len()))
+	}
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,154 @@
+package app
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	devEventsPath = "/api/dev/events"
+	devPoll       = 500 * time.Millisecond
+)
+
+// EditorDir serves an editor build directory on disk as /p, the layout LoadEditorAssets expects of the rice box
+type EditorDir string
+
+func (d EditorDir) Open(name string) (http.File, error) {
+	rest, ok := strings.CutPrefix(path.Clean("/"+name), "/p")
+	if !ok || (rest != "" && rest[0] != '/') {
+		return nil, fs.ErrNotExist
+	}
+	return http.Dir(d).Open(rest)
+}
+
+// devReloader polls Options.EditorDir and tells open editor pages to reload after a build
+type devReloader struct {
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced on every change
+	start   sync.Once
+	stop    sync.Once
+	closing chan struct{}
+}
+
+func newDevReloader() *devReloader {
+	return &devReloader{
+		changed: make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+}
+
+func (d *devReloader) next() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.changed
+}
+
+func (d *devReloader) notify() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// Close stops the watcher and ends the event streams so a graceful shutdown is not held up
+func (d *devReloader) Close() {
+	d.stop.Do(func() { close(d.closing) })
+}
+
+func (s *Server) devMode() bool {
+	return s.Options.EditorDir != ""
+}
+
+// startDevReload polls the editor directory until the server shuts down
+func (s *Server) startDevReload() {
+	if !s.devMode() {
+		return
+	}
+	s.dev.start.Do(func() {
+		go s.watchEditor(s.Options.EditorDir, devPoll)
+	})
+}
+
+func (s *Server) watchEditor(dir string, interval time.Duration) {
+	last := snapshot(dir)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.dev.closing:
+			return
+		case <-ticker.C:
+		}
+		current := snapshot(dir)
+		if current == last {
+			continue
+		}
+		last = current
+		// a build in progress may not have written its manifest yet, the next change retries
+		err := s.LoadEditorAssets(EditorDir(dir))
+		if err != nil {
+			s.Logger.Warn("editor build is incomplete", "err", err)
+			continue
+		}
+		s.Logger.Info("editor changed, reloading pages", "dir", dir)
+		s.dev.notify()
+	}
+}
+
+// snapshot hashes the name, size and modification time of every file under dir
+func snapshot(dir string) uint64 {
+	h := fnv.New64a()
+	_ = filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := entry.Info()
+		if err == nil {
+			_, _ = fmt.Fprintf(h, "%s %d %d\n", name, info.Size(), info.ModTime().UnixNano())
+		}
+		return nil
+	})
+	return h.Sum64()
+}
+
+// DevEventsHandler streams a reload event whenever the editor directory changes
+func (s *Server) DevEventsHandler(w http.ResponseWriter, r *http.Request) {
+	changed := s.dev.next() // subscribe before the headers reach the client
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{}) // streams outlive WriteTimeout
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	keepAlive := time.NewTicker(sessionKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.dev.closing:
+			return
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case <-changed:
+			changed = s.dev.next()
+			_, err = fmt.Fprint(w, "event: reload\ndata: {}\n\n")
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
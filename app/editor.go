@@ -0,0 +1,127 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	editorPrefix   = "/p/"
+	editorVersions = "/p/v/" // extra builds live in /p/v/<version>/
+	assetManifest  = "asset-manifest.json"
+)
+
+// editorBuild is one pflow-editor build, its script and style tags come from the
+// asset-manifest.json written by create-react-app instead of hashes in the template
+type editorBuild struct {
+	Version string
+	Prefix  string // path the build is served under, ends in /
+	Styles  []string
+	Scripts []string
+}
+
+// LoadEditorAssets serves fsys under /p and reads the asset manifest of the default build
+// and of every versioned build, the editor page is unavailable until this succeeds
+func (s *Server) LoadEditorAssets(fsys http.FileSystem) error {
+	if fsys == nil {
+		return errors.New("editor: assets are not loaded, run build.sh")
+	}
+	builds := map[string]*editorBuild{}
+	build, err := readEditorBuild(fsys, "", editorPrefix)
+	if err != nil {
+		return err
+	}
+	builds[""] = build
+	versions, err := listDirs(fsys, editorVersions)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		build, err = readEditorBuild(fsys, version, editorVersions+version+"/")
+		if err != nil {
+			return err
+		}
+		builds[version] = build
+	}
+	s.editorMu.Lock()
+	s.Static = http.FileServer(fsys)
+	s.editors = builds
+	s.editorMu.Unlock()
+	s.Logger.Info("editor assets loaded", "versions", len(versions),
+		"scripts", strings.Join(builds[""].Scripts, ","), "styles", strings.Join(builds[""].Styles, ","))
+	return nil
+}
+
+func readEditorBuild(fsys http.FileSystem, version, prefix string) (*editorBuild, error) {
+	name := prefix + assetManifest
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("editor: %s is missing, the editor build must be copied to public%s: %w", name, prefix, err)
+	}
+	defer f.Close()
+	manifest := struct {
+		Entrypoints []string `json:"entrypoints"`
+	}{}
+	err = json.NewDecoder(io.LimitReader(f, 1<<20)).Decode(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("editor: %s: %w", name, err)
+	}
+	build := &editorBuild{Version: version, Prefix: prefix}
+	for _, entry := range manifest.Entrypoints {
+		if strings.HasPrefix(entry, "/") || strings.Contains(entry, "..") {
+			return nil, fmt.Errorf("editor: %s: entrypoint %s is not relative to the build", name, entry)
+		}
+		switch path.Ext(entry) {
+		case ".css":
+			build.Styles = append(build.Styles, prefix+entry)
+		case ".js":
+			build.Scripts = append(build.Scripts, prefix+entry)
+		}
+	}
+	if len(build.Scripts) == 0 {
+		return nil, fmt.Errorf("editor: %s has no script entrypoints", name)
+	}
+	return build, nil
+}
+
+// listDirs returns the sorted directory names in dir, a missing dir has none
+func listDirs(fsys http.FileSystem, dir string) ([]string, error) {
+	f, err := fsys.Open(dir)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		return nil, fmt.Errorf("editor: %s: %w", dir, err)
+	}
+	names := []string{}
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// editorBuild picks the build named by ?editor=, the default build when it is empty,
+// it responds 503 until LoadEditorAssets succeeds and 404 for an unknown version
+func (s *Server) editorBuild(w http.ResponseWriter, r *http.Request) (*editorBuild, bool) {
+	s.editorMu.RLock()
+	loaded := s.editors != nil
+	build, ok := s.editors[r.URL.Query().Get("editor")]
+	s.editorMu.RUnlock()
+	if !loaded {
+		http.Error(w, "editor assets are not loaded", http.StatusServiceUnavailable)
+	} else if !ok {
+		http.Error(w, "unknown editor version", http.StatusNotFound)
+	}
+	return build, ok
+}
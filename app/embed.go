@@ -0,0 +1,232 @@
+package app
+
+import (
+	"encoding/json"
+	"github.com/pflow-dev/go-metamodel/v2/metamodel"
+	"github.com/pflow-dev/go-metamodel/v2/model"
+	"github.com/pflow-dev/pflow-cli/sealed"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	oembedPath    = "/oembed"
+	defaultEmbedW = 640
+	defaultEmbedH = 480
+	controlsH     = 48 // room for the transition buttons below the svg
+)
+
+// modelPagePath matches the urls oEmbed consumers send, /p/<cid>/ and /embed/<cid>
+var modelPagePath = regexp.MustCompile(`^/(?:p|embed)/([a-zA-Z0-9]+)/?$`)
+
+type embedData struct {
+	Cid         string
+	Title       string
+	Base        string
+	State       string
+	Dark        bool
+	Controls    bool
+	Transitions []string
+}
+
+type oembedResponse struct {
+	Version         string `json:"version"`
+	Type            string `json:"type"`
+	ProviderName    string `json:"provider_name"`
+	ProviderUrl     string `json:"provider_url"`
+	Title           string `json:"title,omitempty"`
+	Html            string `json:"html"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	ThumbnailUrl    string `json:"thumbnail_url"`
+	ThumbnailWidth  int    `json:"thumbnail_width"`
+	ThumbnailHeight int    `json:"thumbnail_height"`
+}
+
+var embedPage = template.Must(template.New("embed.html").Parse(EmbedTemplateSource))
+
+// embeddable returns a stored public model, private models cannot be embedded
+// because an iframe cannot send the share secret
+func (s *Server) embeddable(cid string) (*model.Zblob, int) {
+	z := s.App.Model.GetByCid(cid)
+	if z.IpfsCid != cid || z.ID == 0 {
+		return nil, http.StatusNotFound
+	}
+	if sealed.Is(z.Base64Zipped) {
+		return nil, http.StatusUnauthorized
+	}
+	return z, http.StatusOK
+}
+
+// viewPort is the size the svg is rendered at
+func viewPort(z *model.Zblob) (width int, height int, transitions []string, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	mm := metamodel.New()
+	if _, ok = mm.UnpackFromUrl("?z="+z.Base64Zipped, "model.json"); !ok {
+		return 0, 0, nil, false
+	}
+	_, _, width, height = mm.GetViewPort()
+	for label := range mm.Net().Transitions {
+		transitions = append(transitions, label)
+	}
+	sort.Strings(transitions)
+	return width, height, transitions, true
+}
+
+// EmbedHandler serves an iframe-friendly page with the model svg,
+// ?controls=1 adds a button per transition that drives a simulation session, ?theme=dark inverts the colors
+func (s *Server) EmbedHandler(vars map[string]string, w http.ResponseWriter, r *http.Request) {
+	z, status := s.embeddable(vars["pflowCid"])
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	_, _, transitions, ok := viewPort(z)
+	if !ok {
+		http.Error(w, "stored model cannot be unpacked", http.StatusUnprocessableEntity)
+		return
+	}
+	q := r.URL.Query()
+	data := embedData{
+		Cid:         z.IpfsCid,
+		Title:       z.Title,
+		Base:        link(r, ""),
+		Dark:        q.Get("theme") == "dark",
+		Controls:    q.Get("controls") == "1" || q.Get("controls") == "true",
+		Transitions: transitions,
+	}
+	if _, ok := s.GetState(r); ok {
+		data.State = q.Get("state")
+	}
+	s.viewEvent("modelEmbedded", z, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors *")
+	_ = embedPage.Execute(w, data)
+}
+
+// scaleTo fits width x height into the consumer's maxwidth and maxheight keeping the aspect ratio
+func scaleTo(width, height, maxWidth, maxHeight int) (int, int) {
+	if maxWidth > 0 && width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+	if maxHeight > 0 && height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+	return width, height
+}
+
+// OembedHandler implements the oEmbed json endpoint for model pages
+func (s *Server) OembedHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if format := q.Get("format"); format != "" && format != "json" {
+		http.Error(w, "only the json format is supported", http.StatusNotImplemented)
+		return
+	}
+	target, err := url.Parse(q.Get("url"))
+	if err != nil || target.Path == "" {
+		http.Error(w, "expected ?url= of a model page", http.StatusBadRequest)
+		return
+	}
+	path := strings.TrimPrefix(target.Path, link(r, ""))
+	match := modelPagePath.FindStringSubmatch(path)
+	if match == nil {
+		http.Error(w, "url is not a model page", http.StatusNotFound)
+		return
+	}
+	z, status := s.embeddable(match[1])
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	width, height, _, ok := viewPort(z)
+	if !ok || width <= 0 || height <= 0 {
+		width, height = defaultEmbedW, defaultEmbedH
+	}
+	maxWidth, _ := strconv.Atoi(q.Get("maxwidth"))
+	maxHeight, _ := strconv.Atoi(q.Get("maxheight"))
+	thumbWidth, thumbHeight := scaleTo(width, height, maxWidth, maxHeight)
+	width, height = scaleTo(width, height+controlsH, maxWidth, maxHeight)
+
+	base := s.baseUrl(r)
+	src := base + "/embed/" + z.IpfsCid + "?controls=1"
+	res := oembedResponse{
+		Version:         "1.0",
+		Type:            "rich",
+		ProviderName:    "pflow",
+		ProviderUrl:     base + "/",
+		Title:           z.Title,
+		Html:            `<iframe src="` + template.HTMLEscapeString(src) + `" width="` + strconv.Itoa(width) + `" height="` + strconv.Itoa(height) + `" frameborder="0" loading="lazy" title="` + template.HTMLEscapeString(z.Title) + `"></iframe>`,
+		Width:           width,
+		Height:          height,
+		ThumbnailUrl:    base + "/img/" + z.IpfsCid + ".svg",
+		ThumbnailWidth:  thumbWidth,
+		ThumbnailHeight: thumbHeight,
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+const EmbedTemplateSource = `<!DOCTYPE html>
+<html lang="en"><head><meta charset="utf-8"/>
+	<title>{{.Title}} | pflow</title>
+	<meta name="viewport" content="width=device-width,initial-scale=1"/>
+	<meta name="robots" content="noindex"/>
+	<style>
+		html, body { margin: 0; height: 100%; font-family: sans-serif; background: {{if .Dark}}#1e1e1e{{else}}#fff{{end}}; }
+		body { display: flex; flex-direction: column; }
+		#model { flex: 1; min-height: 0; width: 100%; object-fit: contain;{{if .Dark}} filter: invert(1) hue-rotate(180deg);{{end}} }
+		#controls { display: flex; flex-wrap: wrap; gap: 4px; padding: 8px; align-items: center; }
+		#controls button { font-size: small; }
+		#controls a { margin-left: auto; font-size: small; color: {{if .Dark}}#ccc{{else}}#333{{end}}; }
+	</style>
+</head>
+<body>
+	<img id="model" alt="{{.Title}}" src="{{.Base}}/img/{{.Cid}}.svg{{if .State}}?state={{.State}}{{end}}"/>
+	<div id="controls">
+		{{- if .Controls}}{{range .Transitions}}
+		<button data-action="{{.}}">{{.}}</button>
+		{{- end}}{{end}}
+		<a href="{{.Base}}/p/{{.Cid}}/" target="_blank" rel="noopener">open in pflow</a>
+	</div>
+	{{- if .Controls}}
+	<script>
+	(function () {
+		const base = "{{.Base}}";
+		const cid = "{{.Cid}}";
+		let session = null;
+		async function call(path, body) {
+			const res = await fetch(base + path, {method: "POST", headers: {"Content-Type": "application/json"}, body: JSON.stringify(body)});
+			return res.json();
+		}
+		function show(state) {
+			document.getElementById("model").src = base + "/img/" + cid + ".svg?state=" + encodeURIComponent(JSON.stringify(state.vector));
+			document.querySelectorAll("#controls button").forEach(function (b) {
+				b.disabled = state.enabled.indexOf(b.dataset.action) < 0;
+			});
+		}
+		document.querySelectorAll("#controls button").forEach(function (b) {
+			b.addEventListener("click", async function () {
+				if (!session) {
+					session = (await call("/api/sessions", {cid: cid})).session;
+				}
+				const state = await call("/api/sessions/" + session + "/fire", {action: b.dataset.action});
+				if (state.vector) {
+					show(state);
+				}
+			});
+		});
+	})();
+	</script>
+	{{- end}}
+</body></html>`
@@ -0,0 +1,328 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pflow-dev/go-metamodel/v2/image"
+	"github.com/pflow-dev/go-metamodel/v2/metamodel"
+	"github.com/pflow-dev/go-metamodel/v2/model"
+	"github.com/pflow-dev/pflow-cli/raster"
+	"github.com/pflow-dev/pflow-cli/sealed"
+	"github.com/pflow-dev/pflow-cli/storage"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultEventLimit = 100
+	maxEventLimit     = 1000
+)
+
+// indexData is the model opened by the editor, the path prefix and the editor build whose assets it loads,
+// stored public models also get link preview metadata
+type indexData struct {
+	*model.Zblob
+	Base   string
+	Meta   *pageMeta
+	Editor *editorBuild
+	Dev    bool // reload when the editor directory changes
+}
+
+// pageMeta holds the absolute urls of the Open Graph, Twitter card and oEmbed tags
+type pageMeta struct {
+	Canonical   string
+	Image       string
+	ImageWidth  int
+	ImageHeight int
+	Oembed      string
+}
+
+const (
+	ogImageWidth  = 1200
+	ogImageHeight = 630
+)
+
+func (s *Server) pageMeta(r *http.Request, cid string) *pageMeta {
+	base := s.baseUrl(r)
+	page := base + "/p/" + cid + "/"
+	return &pageMeta{
+		Canonical:   page,
+		Image:       fmt.Sprintf("%s/img/%s.png?width=%d&height=%d", base, cid, ogImageWidth, ogImageHeight),
+		ImageWidth:  ogImageWidth,
+		ImageHeight: ogImageHeight,
+		Oembed:      base + oembedPath + "?format=json&url=" + url.QueryEscape(page),
+	}
+}
+
+func (s *Server) AppPage(vars map[string]string, w http.ResponseWriter, r *http.Request) {
+	cid, found := s.checkForModel(r)
+	if found {
+		http.Redirect(w, r, link(r, "/p/"+cid+"/"), http.StatusFound)
+		return
+	}
+	editor, ok := s.editorBuild(w, r)
+	if !ok {
+		return
+	}
+	var meta *pageMeta
+	m := model.Model{
+		Zblob: &model.Zblob{
+			IpfsCid: cid,
+		},
+	}
+	if z, ok := s.urlModel(r); ok && vars["pflowCid"] == "" {
+		m.Zblob = z // not stored, the editor opens it without a cid
+	} else if vars["pflowCid"] != "" {
+		zblob := s.App.Model.GetByCid(vars["pflowCid"])
+		private := sealed.Is(zblob.Base64Zipped)
+		if private {
+			if _, ok := shareSecret(r); !ok {
+				s.privatePage(w)
+				return
+			}
+			var ok bool
+			zblob, ok = s.unseal(w, r, zblob)
+			if !ok {
+				return
+			}
+		}
+		m = zblob.ToModel()
+		if m.ID != 0 && m.IpfsCid == vars["pflowCid"] {
+			m.MetaModel()
+			s.viewEvent("modelViewed", m.Zblob, r)
+			if !private {
+				meta = s.pageMeta(r, m.IpfsCid)
+			}
+		}
+	}
+	if s.devMode() {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	_ = s.IndexPage().ExecuteTemplate(w, "index.html", indexData{Zblob: m.Zblob, Base: link(r, ""), Meta: meta, Editor: editor, Dev: s.devMode()})
+}
+
+func (s *Server) renderSvg(out io.Writer, m model.Model, r *http.Request) {
+	_, mm := m.MetaModel()
+	x1, y1, width, height := mm.GetViewPort()
+	i := image.NewSvg(out, width, height, x1, y1, width, height)
+
+	state, stateOk := s.GetState(r)
+	if !stateOk || len(state) != len(mm.Net().Places) {
+		state = mm.Net().InitialVector()
+	}
+	i.Render(mm, state)
+}
+
+func (s *Server) SvgHandler(vars map[string]string, w http.ResponseWriter, r *http.Request) {
+	cid, found := s.checkForModel(r)
+	if found {
+		http.Redirect(w, r, link(r, "/img/"+cid+".svg"), http.StatusFound)
+		return
+	}
+	contentType := "image/svg+xml ; charset=utf-8"
+	if vars["pflowCid"] == "" {
+		if z, ok := s.urlModel(r); ok {
+			w.Header().Set("Content-Type", contentType)
+			s.renderSvg(w, z.ToModel(), r)
+		}
+		return
+	}
+	zblob, ok := s.modelOrSnippet(w, r, vars["pflowCid"])
+	if !ok {
+		return
+	}
+	if sealed.Is(zblob.Base64Zipped) {
+		opened, ok := s.unseal(w, r, zblob)
+		if !ok {
+			return
+		}
+		s.viewEvent("svgRendered", opened, r)
+		w.Header().Set("Content-Type", contentType)
+		s.renderSvg(w, opened.ToModel(), r)
+		return
+	}
+	m := zblob.ToModel()
+	if m.IpfsCid != vars["pflowCid"] {
+		w.Header().Set("Content-Type", contentType)
+		return
+	}
+	s.viewEvent("svgRendered", m.Zblob, r)
+	state, _ := s.GetState(r)
+	s.writeCached(w, fmt.Sprintf("svg:%s?state=%v", m.IpfsCid, state), contentType, func(out io.Writer) {
+		s.renderSvg(out, m, r)
+	})
+}
+
+// pngOptions reads ?width=&height=&scale=&background= for PngHandler, the background defaults to white
+func pngOptions(r *http.Request) (raster.Options, error) {
+	q := r.URL.Query()
+	o := raster.Options{Background: color.White}
+	for name, v := range map[string]*int{"width": &o.Width, "height": &o.Height} {
+		if raw := q.Get(name); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 || n > raster.MaxSide {
+				return o, fmt.Errorf("%s must be between 1 and %d", name, raster.MaxSide)
+			}
+			*v = n
+		}
+	}
+	if raw := q.Get("scale"); raw != "" {
+		scale, err := strconv.ParseFloat(raw, 64)
+		if err != nil || scale <= 0 || scale > raster.MaxScale {
+			return o, fmt.Errorf("scale must be greater than 0 and at most %d", raster.MaxScale)
+		}
+		o.Scale = scale
+	}
+	if raw := q.Get("background"); raw != "" {
+		bg, err := raster.ParseColor(raw)
+		if err != nil {
+			return o, err
+		}
+		o.Background = bg
+	}
+	return o, nil
+}
+
+// renderPng waits for a free slot so concurrent requests cannot rasterize on every core at once,
+// nothing is written if the request ends first
+func (s *Server) renderPng(out io.Writer, m model.Model, state metamodel.Vector, o raster.Options, r *http.Request) {
+	select {
+	case s.pngSlots <- struct{}{}:
+		defer func() { <-s.pngSlots }()
+	case <-r.Context().Done():
+		return
+	}
+	_, mm := m.MetaModel()
+	_ = png.Encode(out, raster.Render(mm, state, o))
+}
+
+// pngKey identifies a png by the parsed options and state, so equivalent queries such as
+// ?state=[1,0] and ?state=[1, 0] or #fff and ffffff share one cache entry
+func pngKey(cid string, o raster.Options, state metamodel.Vector) string {
+	scale := o.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	background := "none"
+	if o.Background != nil {
+		r, g, b, a := o.Background.RGBA()
+		background = fmt.Sprintf("%04x%04x%04x%04x", r, g, b, a)
+	}
+	return fmt.Sprintf("png:%s?state=%v&width=%d&height=%d&scale=%g&background=%s",
+		cid, state, o.Width, o.Height, scale, background)
+}
+
+// PngHandler rasterizes a stored model for previews that do not support svg
+func (s *Server) PngHandler(vars map[string]string, w http.ResponseWriter, r *http.Request) {
+	o, err := pngOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state, _ := s.GetState(r) // an invalid state draws the initial marking
+	zblob, ok := s.modelOrSnippet(w, r, vars["pflowCid"])
+	if !ok {
+		return
+	}
+	if sealed.Is(zblob.Base64Zipped) {
+		opened, ok := s.unseal(w, r, zblob)
+		if !ok {
+			return
+		}
+		s.viewEvent("pngRendered", opened, r)
+		w.Header().Set("Content-Type", "image/png")
+		s.renderPng(w, opened.ToModel(), state, o, r)
+		return
+	}
+	m := zblob.ToModel()
+	if m.ID == 0 || m.IpfsCid != vars["pflowCid"] {
+		http.NotFound(w, r)
+		return
+	}
+	s.viewEvent("pngRendered", m.Zblob, r)
+	s.writeCached(w, pngKey(m.IpfsCid, o, state), "image/png", func(out io.Writer) {
+		s.renderPng(out, m, state, o, r)
+	})
+}
+
+func renderJson(out io.Writer, m *model.Zblob) {
+	mm := metamodel.New()
+	mm.UnpackFromUrl("?z="+m.Base64Zipped, "model.json")
+	data, _ := json.MarshalIndent(mm.ToDeclarationObject(), "", "  ")
+	_, err := out.Write(data)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (s *Server) JsonHandler(vars map[string]string, w http.ResponseWriter, r *http.Request) {
+	cid, found := s.checkForModel(r)
+	if found {
+		http.Redirect(w, r, link(r, "/src/"+cid+".json"), http.StatusFound)
+	} else if z, ok := s.urlModel(r); ok && vars["pflowCid"] == "" {
+		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		renderJson(w, z)
+	} else if vars["pflowCid"] != "" {
+		contentType := "application/javascript; charset=utf-8"
+		m, ok := s.modelOrSnippet(w, r, vars["pflowCid"])
+		if !ok {
+			return
+		}
+		if sealed.Is(m.Base64Zipped) {
+			opened, ok := s.unseal(w, r, m)
+			if !ok {
+				return
+			}
+			s.viewEvent("jsonFetched", opened, r)
+			w.Header().Set("Content-Type", contentType)
+			renderJson(w, opened)
+			return
+		}
+		if m.IpfsCid == vars["pflowCid"] {
+			s.viewEvent("jsonFetched", m, r)
+		}
+		s.writeCached(w, "json:"+m.IpfsCid, contentType, func(out io.Writer) {
+			renderJson(out, m)
+		})
+	}
+}
+
+// EventsHandler lists journal entries filtered by ?type= and ?since=
+// since is either the id of the last event seen or an RFC3339 timestamp
+func (s *Server) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := storage.EventQuery{
+		Type:  q.Get("type"),
+		Limit: defaultEventLimit,
+	}
+	if since := q.Get("since"); since != "" {
+		if id, err := strconv.ParseInt(since, 10, 64); err == nil {
+			query.AfterId = id
+		} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+			query.After = t
+		} else {
+			http.Error(w, "since must be an event id or RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || n <= 0 || n > maxEventLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxEventLimit), http.StatusBadRequest)
+			return
+		}
+		query.Limit = n
+	}
+	events, err := s.Store.Events.Query(query)
+	if err != nil {
+		http.Error(w, "Failed to query events", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	healthzPath  = "/healthz"
+	readyzPath   = "/readyz"
+	readyTimeout = 2 * time.Second
+)
+
+// HealthCheck is the outcome of one readiness check
+type HealthCheck struct {
+	Name       string  `json:"name"`
+	Ok         bool    `json:"ok"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+// HealthReport is returned by /healthz and /readyz, Status is "ok" or "unavailable"
+type HealthReport struct {
+	Status     string        `json:"status"`
+	Checks     []HealthCheck `json:"checks"`
+	DurationMs float64       `json:"durationMs"`
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func runChecks(checks []HealthCheck, fns []func() error) HealthReport {
+	start := time.Now()
+	report := HealthReport{Status: "ok", Checks: checks}
+	for i, fn := range fns {
+		checkStart := time.Now()
+		err := fn()
+		report.Checks[i].Ok = err == nil
+		report.Checks[i].DurationMs = millis(time.Since(checkStart))
+		if err != nil {
+			report.Checks[i].Error = err.Error()
+			report.Status = "unavailable"
+		}
+	}
+	report.DurationMs = millis(time.Since(start))
+	return report
+}
+
+// Ready runs the readiness checks, every check runs even when an earlier one fails
+func (s *Server) Ready(ctx context.Context) HealthReport {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	checks := []HealthCheck{{Name: "database"}, {Name: "tables"}, {Name: "static"}}
+	fns := []func() error{
+		func() error { return s.Store.Ping(ctx) },
+		func() error { return s.Store.CheckTables(ctx) },
+		func() error {
+			s.editorMu.RLock()
+			loaded := s.Static != nil
+			s.editorMu.RUnlock()
+			if !loaded {
+				return errors.New("static assets are not loaded")
+			}
+			return nil
+		},
+	}
+	if s.Options.UseSandbox {
+		checks = append(checks, HealthCheck{Name: "sandbox"})
+		fns = append(fns, func() error {
+			if s.SandboxPage() == nil || s.SandboxPage().Lookup("sandbox.html") == nil {
+				return errors.New("sandbox template is not parsed")
+			}
+			if s.sandboxHashes == nil {
+				return errors.New("sandbox assets are not verified")
+			}
+			return nil
+		})
+	}
+	return runChecks(checks, fns)
+}
+
+// HealthzHandler reports that the process is serving requests
+func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJson(w, http.StatusOK, runChecks([]HealthCheck{}, nil))
+}
+
+// ReadyzHandler responds 503 until every readiness check passes
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := s.Ready(r.Context())
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJson(w, status, report)
+}
+
+// isProbe is used to keep orchestrator probes out of the info log
+func isProbe(route string) bool {
+	return route == healthzPath || route == readyzPath
+}
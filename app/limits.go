@@ -0,0 +1,186 @@
+package app
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"github.com/pflow-dev/go-metamodel/v2/server"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxZipFiles       = 8
+	rejectLogInterval = 10 * time.Second
+)
+
+var (
+	errTooLarge   = errors.New("payload too large")
+	errBadPayload = errors.New("payload is not a base64 encoded zip")
+)
+
+// IngestStats counts requests carrying a model or snippet to unzip
+type IngestStats struct {
+	Accepted    uint64 `json:"accepted"`
+	RateLimited uint64 `json:"rateLimited"`
+	TooLarge    uint64 `json:"tooLarge"`
+	Invalid     uint64 `json:"invalid"`
+	Clients     int    `json:"clients"`
+}
+
+type ingestCounters struct {
+	accepted    atomic.Uint64
+	rateLimited atomic.Uint64
+	tooLarge    atomic.Uint64
+	invalid     atomic.Uint64
+	lastLog     atomic.Int64
+}
+
+func (s *Server) IngestStats() IngestStats {
+	return IngestStats{
+		Accepted:    s.ingest.accepted.Load(),
+		RateLimited: s.ingest.rateLimited.Load(),
+		TooLarge:    s.ingest.tooLarge.Load(),
+		Invalid:     s.ingest.invalid.Load(),
+		Clients:     s.ingestLimiter.Len(),
+	}
+}
+
+func (s *Server) LimitsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, s.IngestStats())
+}
+
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// urlPayload returns the ?z= parameters exactly as metamodel.UnzipUrl reads them, without unescaping,
+// UnzipUrl uses the last one so a request must carry at most one to be checked
+func urlPayload(r *http.Request) (payloads []string) {
+	for _, param := range strings.Split(r.URL.RawQuery, "&") {
+		if strings.HasPrefix(param, "z=") {
+			payloads = append(payloads, param[2:])
+		}
+	}
+	return payloads
+}
+
+// checkZip inflates every file of a base64 zip into io.Discard
+// so a small archive that expands beyond maxUnzipped is rejected before it is unpacked
+// limits <= 0 are not enforced
+func checkZip(encoded string, maxZipped int, maxUnzipped int64) error {
+	if maxZipped > 0 && len(encoded) > maxZipped {
+		return errTooLarge
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return errBadPayload
+	}
+	zr, err := zip.NewReader(bytes.NewReader(raw), int64(len(raw)))
+	if err != nil || len(zr.File) > maxZipFiles {
+		return errBadPayload
+	}
+	limit := maxUnzipped
+	if limit <= 0 {
+		limit = math.MaxInt64 - 1
+	}
+	var total int64
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			return errBadPayload
+		}
+		n, err := io.Copy(io.Discard, io.LimitReader(rc, limit-total+1))
+		_ = rc.Close()
+		total += n
+		if total > limit {
+			return errTooLarge
+		}
+		if err != nil {
+			return errBadPayload
+		}
+	}
+	return nil
+}
+
+// admitClient applies the per client rate limit, it sets Retry-After and returns false when the client must wait
+func (s *Server) admitClient(w http.ResponseWriter, r *http.Request) (ok bool, msg string) {
+	ip := clientIp(r)
+	allowed, wait := s.ingestLimiter.Allow(ip)
+	if allowed {
+		return true, ""
+	}
+	s.ingest.rateLimited.Add(1)
+	s.logRejected(http.StatusTooManyRequests, ip)
+	retry := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+	w.Header().Set("Retry-After", retry)
+	return false, "Too many requests, retry in " + retry + "s"
+}
+
+// checkPayload applies the size limits to a zipped payload
+// it returns http.StatusOK or the status to reject the request with
+func (s *Server) checkPayload(r *http.Request, zipped string) (status int, msg string) {
+	switch checkZip(zipped, s.Options.MaxZippedBytes, s.Options.MaxUnzippedBytes) {
+	case nil:
+		s.ingest.accepted.Add(1)
+		return http.StatusOK, ""
+	case errTooLarge:
+		s.ingest.tooLarge.Add(1)
+		s.logRejected(http.StatusRequestEntityTooLarge, clientIp(r))
+		return http.StatusRequestEntityTooLarge, "Payload too large"
+	default:
+		s.ingest.invalid.Add(1)
+		return http.StatusBadRequest, "Invalid zipped payload"
+	}
+}
+
+// limitIngest guards page routes that unzip and store ?z= payloads
+func (s *Server) limitIngest(handler server.HandlerWithVars) server.HandlerWithVars {
+	return func(vars map[string]string, w http.ResponseWriter, r *http.Request) {
+		if payloads := urlPayload(r); len(payloads) > 0 {
+			if ok, msg := s.admitClient(w, r); !ok {
+				http.Error(w, msg, http.StatusTooManyRequests)
+				return
+			}
+			if len(payloads) > 1 {
+				s.ingest.invalid.Add(1)
+				s.logRejected(http.StatusBadRequest, clientIp(r))
+				http.Error(w, "Only one z= parameter is allowed", http.StatusBadRequest)
+				return
+			}
+			if status, msg := s.checkPayload(r, payloads[0]); status != http.StatusOK {
+				http.Error(w, msg, status)
+				return
+			}
+		}
+		handler(vars, w, r)
+	}
+}
+
+// logRejected reports rejections at most once per interval so an attack cannot flood the log
+func (s *Server) logRejected(status int, ip string) {
+	now := time.Now().UnixNano()
+	last := s.ingest.lastLog.Load()
+	if now-last < int64(rejectLogInterval) || !s.ingest.lastLog.CompareAndSwap(last, now) {
+		return
+	}
+	stats := s.IngestStats()
+	s.Logger.Warn("rejected ingest",
+		"remote", ip,
+		"status", status,
+		"rateLimited", stats.RateLimited,
+		"tooLarge", stats.TooLarge,
+		"invalid", stats.Invalid,
+	)
+}
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJson = "json"
+)
+
+// NewLogger returns a slog logger writing text or json records at or above level
+func NewLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == LogFormatJson {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// mapAttrs turns event params into attributes with a stable order
+func mapAttrs(params map[string]interface{}) []any {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]any, 0, len(keys))
+	for _, k := range keys {
+		attrs = append(attrs, slog.Any(k, params[k]))
+	}
+	return attrs
+}
+
+// accessRecord is filled in by routeInfo once the router has matched a route
+type accessRecord struct {
+	route string
+	cid   string
+}
+
+type accessKey struct{}
+
+// statusWriter records the status and size of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// routeInfo is router middleware that records the matched route template and cid for the access log
+func routeInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rec, ok := r.Context().Value(accessKey{}).(*accessRecord); ok {
+			if route := mux.CurrentRoute(r); route != nil {
+				rec.route, _ = route.GetPathTemplate()
+			}
+			vars := mux.Vars(r)
+			rec.cid = vars["pflowCid"]
+			if rec.cid == "" {
+				rec.cid = vars["cid"]
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accessLog writes one record per request, unmatched requests are logged without a route
+func (s *Server) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &accessRecord{}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), accessKey{}, rec)))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		latency := time.Since(start)
+		s.observeRequest(rec.route, r.Method, sw.status, latency)
+		level := slog.LevelInfo
+		if sw.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		} else if isProbe(rec.route) {
+			level = slog.LevelDebug
+		}
+		s.Logger.LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", rec.route),
+			slog.String("cid", rec.cid),
+			slog.Int("status", sw.status),
+			slog.Int64("bytes", sw.bytes),
+			slog.Duration("latency", latency),
+			slog.String("referrer", r.Header.Get("Referer")),
+			slog.String("remote", clientIp(r)),
+		)
+	})
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"github.com/pflow-dev/pflow-cli/cache"
+	"github.com/pflow-dev/pflow-cli/metrics"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const metricsPath = "/metrics"
+
+// serverMetrics are updated as requests are served, everything else is collected on scrape
+type serverMetrics struct {
+	registry     *metrics.Registry
+	requests     *metrics.CounterVec
+	latency      *metrics.HistogramVec
+	queryLatency *metrics.HistogramVec
+}
+
+func (s *Server) metricsEnabled() bool {
+	return s.Options.Metrics || s.Options.MetricsAddr != ""
+}
+
+func (s *Server) newMetrics() *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		requests: r.Counter("pflow_http_requests_total",
+			"HTTP requests by route template, method and status.", "route", "method", "status"),
+		latency: r.Histogram("pflow_http_request_duration_seconds",
+			"HTTP request latency by route template.", metrics.DefaultBuckets, "route"),
+		queryLatency: r.Histogram("pflow_sqlite_query_duration_seconds",
+			"Storage call latency by table and operation, writes include queue time.", metrics.DefaultBuckets, "table", "op"),
+	}
+	s.Store.ObserveQueries(func(table, op string, d time.Duration) {
+		m.queryLatency.Observe(d.Seconds(), table, op)
+	})
+
+	r.CounterFunc("pflow_blobs_created_total", "Models and snippets inserted.", func(emit metrics.Emit) {
+		emit(float64(s.Store.Model.Counts().Created), "model")
+		emit(float64(s.Store.Snippet.Counts().Created), "snippet")
+	}, "kind")
+	r.CounterFunc("pflow_blob_duplicates_total", "Inserts of a cid that was already stored.", func(emit metrics.Emit) {
+		emit(float64(s.Store.Model.Counts().Duplicates), "model")
+		emit(float64(s.Store.Snippet.Counts().Duplicates), "snippet")
+	}, "kind")
+	r.CounterFunc("pflow_unzip_failures_total", "Invalid ?z= payloads recovered while unzipping.", func(emit metrics.Emit) {
+		emit(float64(s.unzipFailures.Load()))
+	})
+	r.CounterFunc("pflow_views_dropped_total", "Page views not journaled because the view queue was full.", func(emit metrics.Emit) {
+		emit(float64(s.views.dropped.Load()))
+	})
+	r.CounterFunc("pflow_ingest_rejected_total", "Ingest requests rejected by rate or size limits.", func(emit metrics.Emit) {
+		stats := s.IngestStats()
+		emit(float64(stats.RateLimited), "rate_limited")
+		emit(float64(stats.TooLarge), "too_large")
+		emit(float64(stats.Invalid), "invalid")
+	}, "reason")
+
+	cacheStat := func(value func(cache.Stats) float64) func(metrics.Emit) {
+		return func(emit metrics.Emit) {
+			for name, stats := range s.CacheStats() {
+				emit(value(stats), name)
+			}
+		}
+	}
+	r.CounterFunc("pflow_cache_hits_total", "Cache hits.", cacheStat(func(c cache.Stats) float64 { return float64(c.Hits) }), "cache")
+	r.CounterFunc("pflow_cache_misses_total", "Cache misses.", cacheStat(func(c cache.Stats) float64 { return float64(c.Misses) }), "cache")
+	r.CounterFunc("pflow_cache_evictions_total", "Cache evictions.", cacheStat(func(c cache.Stats) float64 { return float64(c.Evictions) }), "cache")
+	r.GaugeFunc("pflow_cache_entries", "Cached entries.", cacheStat(func(c cache.Stats) float64 { return float64(c.Entries) }), "cache")
+	r.GaugeFunc("pflow_cache_bytes", "Estimated cache memory.", cacheStat(func(c cache.Stats) float64 { return float64(c.Bytes) }), "cache")
+	return m
+}
+
+// observeRequest is called by the access log once a response is written
+func (s *Server) observeRequest(route, method string, status int, d time.Duration) {
+	if s.metrics == nil {
+		return
+	}
+	if route == "" {
+		route = "unmatched"
+	}
+	s.metrics.requests.Inc(route, method, strconv.Itoa(status))
+	s.metrics.latency.Observe(d.Seconds(), route)
+}
+
+// unzipFailed counts and logs a panic recovered while unpacking a ?z= payload
+func (s *Server) unzipFailed(r interface{}) {
+	s.unzipFailures.Add(1)
+	s.Logger.Debug("recovered from panic while unzipping", "panic", r)
+}
+
+func (s *Server) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = s.metrics.registry.WriteText(w)
+}
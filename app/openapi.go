@@ -0,0 +1,646 @@
+package app
+
+import (
+	"github.com/pflow-dev/pflow-cli/raster"
+	"net/http"
+	"strings"
+)
+
+// OpenAPI 3 description of the http surface, served at /api/openapi.json
+// every route registered in routes must have an entry here, see TestOpenApiCoversRoutes
+
+const openApiPath = "/api/openapi.json"
+
+type openApiDoc struct {
+	OpenApi    string                       `json:"openapi"`
+	Info       openApiInfo                  `json:"info"`
+	Servers    []openApiServer              `json:"servers,omitempty"`
+	Paths      map[string]map[string]*apiOp `json:"paths"`
+	Components openApiComponents            `json:"components"`
+}
+
+type openApiInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Version     string `json:"version"`
+}
+
+type openApiServer struct {
+	Url string `json:"url"`
+}
+
+type openApiComponents struct {
+	Schemas         map[string]schema         `json:"schemas"`
+	SecuritySchemes map[string]securityScheme `json:"securitySchemes"`
+}
+
+type securityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	In          string `json:"in,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type apiOp struct {
+	OperationId string                `json:"operationId"`
+	Summary     string                `json:"summary"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []apiParam            `json:"parameters,omitempty"`
+	RequestBody *apiBody              `json:"requestBody,omitempty"`
+	Responses   map[string]apiResult  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+// writeOp marks an operation as a write, it needs an api token when the server requires one
+func writeOp(op *apiOp) *apiOp {
+	op.Security = []map[string][]string{{"bearer": {}}, {"apiToken": {}}}
+	op.Responses["401"] = apiFailure("a valid api token is required")
+	op.Responses["403"] = apiFailure("server is read-only")
+	return op
+}
+
+type apiParam struct {
+	Name        string `json:"name"`
+	In          string `json:"in"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+	Schema      schema `json:"schema"`
+}
+
+type apiBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]mediaType `json:"content"`
+}
+
+type apiResult struct {
+	Description string               `json:"description"`
+	Content     map[string]mediaType `json:"content,omitempty"`
+}
+
+type mediaType struct {
+	Schema schema `json:"schema"`
+}
+
+type schema struct {
+	Ref                  string            `json:"$ref,omitempty"`
+	Type                 string            `json:"type,omitempty"`
+	Format               string            `json:"format,omitempty"`
+	Description          string            `json:"description,omitempty"`
+	Properties           map[string]schema `json:"properties,omitempty"`
+	Items                *schema           `json:"items,omitempty"`
+	AdditionalProperties *schema           `json:"additionalProperties,omitempty"`
+	Enum                 []string          `json:"enum,omitempty"`
+	Minimum              *int              `json:"minimum,omitempty"`
+	Maximum              *int              `json:"maximum,omitempty"`
+}
+
+var (
+	str     = schema{Type: "string"}
+	integer = schema{Type: "integer", Format: "int64"}
+	boolean = schema{Type: "boolean"}
+	number  = schema{Type: "number"}
+	object  = schema{Type: "object"}
+)
+
+func ref(name string) schema {
+	return schema{Ref: "#/components/schemas/" + name}
+}
+
+func arrayOf(s schema) schema {
+	return schema{Type: "array", Items: &s}
+}
+
+func bounded(s schema, min, max int) schema {
+	s.Minimum, s.Maximum = &min, &max
+	return s
+}
+
+func pathParam(name, description string) apiParam {
+	return apiParam{Name: name, In: "path", Description: description, Required: true, Schema: str}
+}
+
+func queryParam(name, description string, s schema) apiParam {
+	return apiParam{Name: name, In: "query", Description: description, Schema: s}
+}
+
+func mediaContent(contentType string, s schema) map[string]mediaType {
+	return map[string]mediaType{contentType: {Schema: s}}
+}
+
+func jsonContent(s schema) map[string]mediaType {
+	return mediaContent("application/json", s)
+}
+
+func response(description string, contentType string, s schema) apiResult {
+	return apiResult{Description: description, Content: mediaContent(contentType, s)}
+}
+
+func apiFailure(description string) apiResult {
+	return apiResult{Description: description, Content: jsonContent(ref("Error"))}
+}
+
+func textFailure(description string) apiResult {
+	return apiResult{Description: description, Content: mediaContent("text/plain", str)}
+}
+
+var (
+	cidParam   = pathParam("pflowCid", "content identifier of a model or snippet")
+	zParam     = queryParam("z", "base64 zipped content, stored and redirected to its cid", str)
+	secretOpt  = apiParam{Name: "Authorization", In: "header", Description: "`Secret <secret>` for private models", Schema: str}
+	htmlSchema = schema{Type: "string", Format: "html"}
+)
+
+// modelPages documents a route pair like /p/ and /p/{pflowCid}/ that serves the same handler
+func modelPages(paths map[string]map[string]*apiOp, base, suffix, id, summary string, op apiOp) {
+	withZ := op
+	withZ.OperationId, withZ.Summary = id, summary+" from a ?z= link"
+	withZ.Parameters = append([]apiParam{zParam}, op.Parameters...)
+	withZ.Responses = map[string]apiResult{
+		"400": textFailure("invalid ?z= payload"),
+		"413": textFailure("payload too large, compressed or inflated"),
+		"429": textFailure("too many ?z= requests from this client, see Retry-After"),
+	}
+	for code, r := range op.Responses {
+		withZ.Responses[code] = r
+	}
+	paths[base] = map[string]*apiOp{"get": &withZ}
+
+	byCid := op
+	byCid.OperationId, byCid.Summary = id+"ByCid", summary+" by cid"
+	byCid.Parameters = append([]apiParam{cidParam}, op.Parameters...)
+	paths[base+"{pflowCid}"+suffix] = map[string]*apiOp{"get": &byCid}
+}
+
+// OpenApi describes the routes registered by routes
+func (s *Server) OpenApi() openApiDoc {
+	paths := map[string]map[string]*apiOp{}
+	notFound := textFailure("unknown cid")
+	private := map[string]apiResult{
+		"401": textFailure("private model requires a share secret"),
+		"403": textFailure("invalid share secret"),
+	}
+	withPrivate := func(responses map[string]apiResult) map[string]apiResult {
+		for code, r := range private {
+			responses[code] = r
+		}
+		return responses
+	}
+
+	modelPages(paths, "/p/", "/", "appPage", "Model editor page", apiOp{
+		Tags:       []string{"pages"},
+		Parameters: []apiParam{queryParam("editor", "load a versioned editor build from /p/v/<editor>/ instead of the default", str), secretOpt},
+		Responses: withPrivate(map[string]apiResult{
+			"200": response("editor page", "text/html", htmlSchema),
+			"302": {Description: "redirect to the stored model"},
+			"404": textFailure("unknown editor version"),
+			"503": textFailure("editor assets are not loaded"),
+		}),
+	})
+	modelPages(paths, "/img/", ".svg", "modelSvg", "Render a model as svg", apiOp{
+		Tags:       []string{"render"},
+		Parameters: []apiParam{queryParam("state", "json token vector to draw instead of the initial state", str), secretOpt},
+		Responses: withPrivate(map[string]apiResult{
+			"200": response("rendered model", "image/svg+xml", str),
+			"404": notFound,
+		}),
+	})
+	paths["/img/{pflowCid}.png"] = map[string]*apiOp{"get": {
+		OperationId: "modelPng",
+		Summary:     "Render a model as png",
+		Tags:        []string{"render"},
+		Parameters: []apiParam{
+			cidParam,
+			queryParam("state", "json token vector to draw instead of the initial state", str),
+			queryParam("width", "image width in pixels, the height follows the aspect ratio unless given", bounded(integer, 1, raster.MaxSide)),
+			queryParam("height", "image height in pixels", bounded(integer, 1, raster.MaxSide)),
+			queryParam("scale", "multiplies the size for high density screens, at most 4", number),
+			queryParam("background", "hex color like #fff or transparent, default white", str),
+			secretOpt,
+		},
+		Responses: withPrivate(map[string]apiResult{
+			"200": response("rendered model", "image/png", schema{Type: "string", Format: "binary"}),
+			"400": textFailure("invalid size, scale or background"),
+			"404": notFound,
+		}),
+	}}
+	modelPages(paths, "/src/", ".json", "modelJson", "Fetch a model as json", apiOp{
+		Tags:       []string{"render"},
+		Parameters: []apiParam{secretOpt},
+		Responses: withPrivate(map[string]apiResult{
+			"200": response("model declaration", "application/json", object),
+			"404": notFound,
+		}),
+	})
+	snippetFailed := textFailure("the cid is a declaration.js snippet that failed, timed out or allocated too much, failures are cached briefly")
+	snippetLimited := textFailure("too many snippet evaluations from this client, see Retry-After")
+	for _, byCid := range []string{"/img/{pflowCid}.svg", "/img/{pflowCid}.png", "/src/{pflowCid}.json"} {
+		paths[byCid]["get"].Responses["422"] = snippetFailed
+		paths[byCid]["get"].Responses["429"] = snippetLimited
+	}
+	if s.Options.UseSandbox {
+		modelPages(paths, "/sandbox/", "/", "sandbox", "Snippet sandbox page", apiOp{
+			Tags: []string{"pages"},
+			Responses: map[string]apiResult{
+				"200": response("sandbox page", "text/html", htmlSchema),
+				"503": textFailure("sandbox assets are not loaded"),
+			},
+		})
+		paths[sandboxStaticPath] = map[string]*apiOp{"get": {
+			OperationId: "sandboxAssets",
+			Summary:     "Vendored scripts and styles of the sandbox, any asset pinned in sandbox/sandbox.go below this prefix",
+			Tags:        []string{"pages"},
+			Responses: map[string]apiResult{
+				"200": {Description: "asset, its hash is in the integrity attribute of the sandbox page"},
+				"404": textFailure("not a vendored asset"),
+			},
+		}}
+	}
+	paths["/car/{pflowCid}.car"] = map[string]*apiOp{"get": {
+		OperationId: "carExport",
+		Summary:     "Download a model or snippet as a CARv1 archive",
+		Tags:        []string{"export"},
+		Parameters:  []apiParam{cidParam},
+		Responses: map[string]apiResult{
+			"200": response("archive", "application/vnd.ipld.car", schema{Type: "string", Format: "binary"}),
+			"404": notFound,
+			"409": textFailure("stored content does not match its cid"),
+		},
+	}}
+	paths["/embed/{pflowCid}"] = map[string]*apiOp{"get": {
+		OperationId: "embedPage",
+		Summary:     "Minimal page for iframes with the model svg and optional controls",
+		Tags:        []string{"pages"},
+		Parameters: []apiParam{
+			cidParam,
+			queryParam("state", "json token vector to draw instead of the initial state", str),
+			queryParam("controls", "1 to add a button per transition, fired through a simulation session", str),
+			queryParam("theme", "light or dark", schema{Type: "string", Enum: []string{"light", "dark"}}),
+		},
+		Responses: map[string]apiResult{
+			"200": response("embed page", "text/html", htmlSchema),
+			"401": textFailure("private models cannot be embedded"),
+			"404": notFound,
+		},
+	}}
+	paths[oembedPath] = map[string]*apiOp{"get": {
+		OperationId: "oembed",
+		Summary:     "oEmbed provider for model pages",
+		Tags:        []string{"pages"},
+		Parameters: []apiParam{
+			queryParam("url", "a /p/{pflowCid}/ or /embed/{pflowCid} url", str),
+			queryParam("maxwidth", "maximum width of the iframe", integer),
+			queryParam("maxheight", "maximum height of the iframe", integer),
+			queryParam("format", "only json is supported", str),
+		},
+		Responses: map[string]apiResult{
+			"200": response("oEmbed rich response", "application/json", ref("Oembed")),
+			"400": textFailure("missing url"),
+			"401": textFailure("private models cannot be embedded"),
+			"404": textFailure("url is not a stored model page"),
+			"501": textFailure("format other than json"),
+		},
+	}}
+	paths["/api/events"] = map[string]*apiOp{"get": {
+		OperationId: "listEvents",
+		Summary:     "Query the server event journal",
+		Tags:        []string{"admin"},
+		Parameters: []apiParam{
+			queryParam("type", "only return events of this type", str),
+			queryParam("since", "event id or RFC3339 timestamp to start after", str),
+			queryParam("limit", "maximum number of events", bounded(integer, 1, maxEventLimit)),
+		},
+		Responses: map[string]apiResult{
+			"200": response("events", "application/json", arrayOf(ref("Event"))),
+			"400": textFailure("invalid query"),
+		},
+	}}
+	paths["/api/cache"] = map[string]*apiOp{"get": {
+		OperationId: "cacheStats",
+		Summary:     "Cache hit and eviction counters",
+		Tags:        []string{"admin"},
+		Responses: map[string]apiResult{
+			"200": response("stats per cache", "application/json", schema{Type: "object", AdditionalProperties: &object}),
+		},
+	}}
+	paths["/api/limits"] = map[string]*apiOp{"get": {
+		OperationId: "ingestStats",
+		Summary:     "Rate limit and payload size counters",
+		Tags:        []string{"admin"},
+		Responses: map[string]apiResult{
+			"200": response("counters", "application/json", ref("IngestStats")),
+		},
+	}}
+	paths[healthzPath] = map[string]*apiOp{"get": {
+		OperationId: "healthz",
+		Summary:     "Liveness probe",
+		Tags:        []string{"admin"},
+		Responses: map[string]apiResult{
+			"200": response("the process is serving requests", "application/json", ref("Health")),
+		},
+	}}
+	paths[readyzPath] = map[string]*apiOp{"get": {
+		OperationId: "readyz",
+		Summary:     "Readiness probe: database, tables, static assets and the sandbox template and assets",
+		Tags:        []string{"admin"},
+		Responses: map[string]apiResult{
+			"200": response("every check passed", "application/json", ref("Health")),
+			"503": response("at least one check failed", "application/json", ref("Health")),
+		},
+	}}
+	if s.metrics != nil && s.admin == nil {
+		paths[metricsPath] = map[string]*apiOp{"get": {
+			OperationId: "metrics",
+			Summary:     "Prometheus metrics",
+			Tags:        []string{"admin"},
+			Responses: map[string]apiResult{
+				"200": response("metrics in the Prometheus text format", "text/plain", str),
+			},
+		}}
+	}
+	if s.devMode() {
+		paths[devEventsPath] = map[string]*apiOp{"get": {
+			OperationId: "devEvents",
+			Summary:     "Server-sent reload events when EDITOR_DIR changes",
+			Tags:        []string{"admin"},
+			Responses: map[string]apiResult{
+				"200": response("a reload event after each editor build", "text/event-stream", str),
+			},
+		}}
+	}
+	paths[openApiPath] = map[string]*apiOp{"get": {
+		OperationId: "openApi",
+		Summary:     "This document",
+		Tags:        []string{"admin"},
+		Responses: map[string]apiResult{
+			"200": response("OpenAPI 3 document", "application/json", object),
+		},
+	}}
+	for _, c := range s.collections() {
+		s.documentCollection(paths, c.kind)
+	}
+	documentSessions(paths)
+
+	doc := openApiDoc{
+		OpenApi: "3.0.3",
+		Info: openApiInfo{
+			Title:       "pflow",
+			Description: "Petri-net model editor and storage",
+			Version:     "v1",
+		},
+		Paths: paths,
+		Components: openApiComponents{
+			Schemas: openApiSchemas(),
+			SecuritySchemes: map[string]securityScheme{
+				"bearer":   {Type: "http", Scheme: "bearer", Description: "api token created with `pflow token create`"},
+				"apiToken": {Type: "apiKey", In: "header", Name: apiTokenHeader, Description: "api token, for requests that also send a share secret"},
+			},
+		},
+	}
+	if s.Options.Url != "" {
+		doc.Servers = []openApiServer{{Url: s.Options.Url}}
+	}
+	return doc
+}
+
+func (s *Server) documentCollection(paths map[string]map[string]*apiOp, kind string) {
+	base := apiPrefix + "/" + kind + "s"
+	title := strings.ToUpper(kind[:1]) + kind[1:]
+	tags := []string{kind + "s"}
+	cid := pathParam("cid", "content identifier of the "+kind)
+	blob := ref("Blob")
+
+	paths[base] = map[string]*apiOp{
+		"get": {
+			OperationId: "list" + title + "s",
+			Summary:     "List " + kind + "s, newest first",
+			Tags:        tags,
+			Parameters: []apiParam{
+				queryParam("offset", "number of rows to skip", integer),
+				queryParam("limit", "page size", bounded(integer, 1, maxListLimit)),
+			},
+			Responses: map[string]apiResult{
+				"200": response("page of "+kind+"s", "application/json", ref("List")),
+				"400": apiFailure("invalid paging"),
+			},
+		},
+		"post": writeOp(&apiOp{
+			OperationId: "create" + title,
+			Summary:     "Store a " + kind + ", the server computes its cid",
+			Tags:        tags,
+			Parameters: []apiParam{
+				queryParam("title", "used when the body has no title", str),
+				queryParam("description", "used when the body has no description", str),
+				queryParam("keywords", "used when the body has no keywords", str),
+				secretOpt,
+			},
+			RequestBody: &apiBody{Required: true, Content: map[string]mediaType{
+				"application/json": {Schema: ref("Upload")},
+				"text/javascript":  {Schema: str},
+			}},
+			Responses: map[string]apiResult{
+				"201": response("created", "application/json", blob),
+				"200": response("already stored", "application/json", blob),
+				"400": apiFailure("invalid " + kind),
+				"413": apiFailure("body or inflated data too large"),
+				"429": apiFailure("too many uploads from this client, see Retry-After"),
+			},
+		}),
+	}
+	paths[base+"/{cid}"] = map[string]*apiOp{
+		"get": {
+			OperationId: "get" + title,
+			Summary:     "Fetch a " + kind + " with its content",
+			Tags:        tags,
+			Parameters:  []apiParam{cid, secretOpt},
+			Responses: map[string]apiResult{
+				"200": response(kind, "application/json", blob),
+				"401": apiFailure("private model requires a share secret"),
+				"403": apiFailure("invalid share secret"),
+				"404": apiFailure("not found"),
+			},
+		},
+		"patch": writeOp(&apiOp{
+			OperationId: "update" + title,
+			Summary:     "Update " + kind + " metadata",
+			Tags:        tags,
+			Parameters:  []apiParam{cid},
+			RequestBody: &apiBody{Required: true, Content: jsonContent(ref("Patch"))},
+			Responses: map[string]apiResult{
+				"200": response("updated", "application/json", blob),
+				"400": apiFailure("invalid body"),
+				"404": apiFailure("not found"),
+			},
+		}),
+		"delete": writeOp(&apiOp{
+			OperationId: "delete" + title,
+			Summary:     "Remove a " + kind,
+			Tags:        tags,
+			Parameters:  []apiParam{cid},
+			Responses: map[string]apiResult{
+				"204": {Description: "deleted"},
+				"404": apiFailure("not found"),
+			},
+		}),
+	}
+}
+
+func documentSessions(paths map[string]map[string]*apiOp) {
+	tags := []string{"sessions"}
+	id := pathParam("session", "session id returned when the session was created")
+	state := ref("SessionState")
+	paths[sessionsPath] = map[string]*apiOp{"post": {
+		OperationId: "createSession",
+		Summary:     "Start a shared simulation of a stored model",
+		Tags:        tags,
+		Parameters:  []apiParam{secretOpt},
+		RequestBody: &apiBody{Required: true, Content: jsonContent(schema{Type: "object", Properties: map[string]schema{
+			"cid": str,
+		}})},
+		Responses: map[string]apiResult{
+			"201": response("initial state", "application/json", state),
+			"400": apiFailure("missing cid"),
+			"401": apiFailure("private model requires a share secret"),
+			"403": apiFailure("invalid share secret"),
+			"404": apiFailure("model not found"),
+			"429": apiFailure("too many requests from this client, see Retry-After"),
+			"503": apiFailure("too many running sessions"),
+		},
+	}}
+	paths[sessionsPath+"/{session}"] = map[string]*apiOp{
+		"get": {
+			OperationId: "getSession",
+			Summary:     "Current state of a session",
+			Tags:        tags,
+			Parameters:  []apiParam{id},
+			Responses: map[string]apiResult{
+				"200": response("state", "application/json", state),
+				"404": apiFailure("session not found"),
+			},
+		},
+		"delete": {
+			OperationId: "deleteSession",
+			Summary:     "End a session and disconnect its subscribers",
+			Tags:        tags,
+			Parameters:  []apiParam{id},
+			Responses: map[string]apiResult{
+				"204": {Description: "ended"},
+				"404": apiFailure("session not found"),
+			},
+		},
+	}
+	paths[sessionsPath+"/{session}/fire"] = map[string]*apiOp{"post": {
+		OperationId: "fireTransition",
+		Summary:     "Fire a transition, subscribers receive the new state",
+		Tags:        tags,
+		Parameters:  []apiParam{id},
+		RequestBody: &apiBody{Required: true, Content: jsonContent(schema{Type: "object", Properties: map[string]schema{
+			"action":   str,
+			"multiple": integer,
+			"role":     str,
+		}})},
+		Responses: map[string]apiResult{
+			"200": response("new state", "application/json", state),
+			"400": apiFailure("missing action"),
+			"404": apiFailure("session not found"),
+			"409": apiFailure("transition is not enabled"),
+		},
+	}}
+	paths[sessionsPath+"/{session}/events"] = map[string]*apiOp{"get": {
+		OperationId: "sessionEvents",
+		Summary:     "Server-sent state events, the current state first and an end event when the session ends",
+		Tags:        tags,
+		Parameters:  []apiParam{id},
+		Responses: map[string]apiResult{
+			"200": response("event stream of SessionState", "text/event-stream", str),
+			"404": apiFailure("session not found"),
+		},
+	}}
+}
+
+func openApiSchemas() map[string]schema {
+	timestamp := schema{Type: "string", Format: "date-time"}
+	return map[string]schema{
+		"Blob": {Type: "object", Properties: map[string]schema{
+			"cid":         str,
+			"title":       str,
+			"description": str,
+			"keywords":    str,
+			"private":     boolean,
+			"created":     timestamp,
+			"data":        {Type: "string", Description: "base64 zipped content"},
+			"model":       {Type: "object", Description: "model declaration, models only"},
+			"source":      {Type: "string", Description: "javascript source, snippets only"},
+		}},
+		"List": {Type: "object", Properties: map[string]schema{
+			"items":  arrayOf(ref("Blob")),
+			"offset": integer,
+			"limit":  integer,
+		}},
+		"Upload": {Type: "object", Description: "metadata plus one of data, model or source; a raw model.json is also accepted", Properties: map[string]schema{
+			"title":       str,
+			"description": str,
+			"keywords":    str,
+			"data":        {Type: "string", Description: "base64 zipped content"},
+			"model":       {Type: "object", Description: "model declaration"},
+			"source":      {Type: "string", Description: "javascript source"},
+		}},
+		"Patch": {Type: "object", Properties: map[string]schema{
+			"title":       str,
+			"description": str,
+			"keywords":    str,
+		}},
+		"Event": {Type: "object", Properties: map[string]schema{
+			"id":      integer,
+			"type":    str,
+			"params":  object,
+			"created": timestamp,
+		}},
+		"IngestStats": {Type: "object", Properties: map[string]schema{
+			"accepted":    integer,
+			"rateLimited": integer,
+			"tooLarge":    integer,
+			"invalid":     integer,
+			"clients":     integer,
+		}},
+		"Health": {Type: "object", Properties: map[string]schema{
+			"status":     {Type: "string", Enum: []string{"ok", "unavailable"}},
+			"durationMs": number,
+			"checks": arrayOf(schema{Type: "object", Properties: map[string]schema{
+				"name":       str,
+				"ok":         boolean,
+				"error":      str,
+				"durationMs": number,
+			}}),
+		}},
+		"SessionState": {Type: "object", Properties: map[string]schema{
+			"session": str,
+			"cid":     str,
+			"seq":     integer,
+			"action":  {Type: "string", Description: "the transition that produced this state"},
+			"tokens":  {Type: "object", AdditionalProperties: &integer},
+			"vector":  arrayOf(integer),
+			"enabled": arrayOf(str),
+		}},
+		"Oembed": {Type: "object", Properties: map[string]schema{
+			"version":          str,
+			"type":             str,
+			"provider_name":    str,
+			"provider_url":     str,
+			"title":            str,
+			"html":             {Type: "string", Description: "iframe of the /embed page"},
+			"width":            integer,
+			"height":           integer,
+			"thumbnail_url":    str,
+			"thumbnail_width":  integer,
+			"thumbnail_height": integer,
+		}},
+		"Error": {Type: "object", Properties: map[string]schema{
+			"error": str,
+		}},
+	}
+}
+
+func (s *Server) OpenApiHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, s.OpenApi())
+}
@@ -0,0 +1,129 @@
+package app
+
+import (
+	"github.com/pflow-dev/go-metamodel/v2/codec"
+	"github.com/pflow-dev/go-metamodel/v2/model"
+	"github.com/pflow-dev/pflow-cli/sealed"
+	"net/http"
+	"strings"
+)
+
+const secretScheme = "Secret"
+
+// shareSecret reads the secret of a private model from an `Authorization: Secret <secret>` header
+// browsers keep the secret in the url fragment and send it with privatePage
+func shareSecret(r *http.Request) (string, bool) {
+	scheme, secret, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, secretScheme) || secret == "" {
+		return "", false
+	}
+	return secret, true
+}
+
+// checkForModel stores a ?z= model, sealing it when the request carries a share secret
+// requests that may not write only find models that are already stored
+func (s *Server) checkForModel(r *http.Request) (string, bool) {
+	write := s.canWrite(r)
+	if secret, ok := shareSecret(r); ok && write {
+		return s.storePrivateModel(secret, s.baseUrl(r), r.URL.String(), r.Header.Get("Referer"))
+	}
+	return s.storeModel(s.baseUrl(r), r.URL.String(), r.Header.Get("Referer"), write)
+}
+
+// storePrivateModel seals the model modelFromUrl reads, so public and private models are normalized alike
+func (s *Server) storePrivateModel(secret string, base string, url string, referrer string) (string, bool) {
+	_, zippedData, foundInUrl := s.modelFromUrl(url)
+	if !foundInUrl {
+		return "", false
+	}
+	sealedData, err := sealed.Seal(secret, zippedData)
+	if err != nil {
+		s.Logger.Error("failed to seal private model", "err", err)
+		return "", false
+	}
+	cid := codec.ToOid(codec.Marshal(sealedData)).String()
+	id, err := s.App.Model.Create(cid, sealedData, "Untitled", "", "", referrer)
+	if err != nil {
+		s.Logger.Error("failed to store private model", "err", err)
+		return "", false
+	}
+	s.recordEvent("modelUnzipped", map[string]interface{}{
+		"id":       id,
+		"cid":      cid,
+		"link":     base + "/p/" + cid + "/",
+		"referrer": referrer,
+		"private":  true,
+	})
+	return cid, true
+}
+
+// openSealed returns a decrypted copy of a private model along with
+// the http status to report when the secret is missing or wrong
+func openSealed(r *http.Request, zblob *model.Zblob) (*model.Zblob, int, string) {
+	secret, ok := shareSecret(r)
+	if !ok {
+		return nil, http.StatusUnauthorized, "Private model requires a share secret"
+	}
+	zipped, err := sealed.Open(secret, zblob.Base64Zipped)
+	if err != nil {
+		return nil, http.StatusForbidden, "Invalid share secret"
+	}
+	opened := *zblob
+	opened.Base64Zipped = zipped
+	return &opened, http.StatusOK, ""
+}
+
+// unseal returns a decrypted copy of a private model,
+// or writes an error response and returns false when the secret is missing or wrong
+func (s *Server) unseal(w http.ResponseWriter, r *http.Request, zblob *model.Zblob) (*model.Zblob, bool) {
+	opened, status, msg := openSealed(r, zblob)
+	if status != http.StatusOK {
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", secretScheme)
+		}
+		http.Error(w, msg, status)
+		return nil, false
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	return opened, true
+}
+
+// privatePage reads the secret from the url fragment and reloads the page with it
+func (s *Server) privatePage(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("WWW-Authenticate", secretScheme)
+	w.WriteHeader(http.StatusUnauthorized)
+	_, _ = w.Write([]byte(PrivatePageSource))
+}
+
+const PrivatePageSource = `<!DOCTYPE html>
+<html lang="en"><head><meta charset="utf-8"/>
+	<title>pflow | private model</title>
+	<meta name="robots" content="noindex"/>
+</head>
+<body>
+	<p id="status">This model is private, open it with a link that includes its secret.</p>
+	<script>
+	(function () {
+		var secret = new URLSearchParams(location.hash.slice(1)).get("secret");
+		if (!secret) {
+			return;
+		}
+		fetch(location.pathname + location.search, {headers: {Authorization: "Secret " + secret}})
+			.then(function (res) {
+				if (!res.ok) {
+					throw new Error(res.status === 403 ? "wrong secret" : res.statusText);
+				}
+				return res.text();
+			})
+			.then(function (html) {
+				document.open();
+				document.write(html);
+				document.close();
+			})
+			.catch(function (err) {
+				document.getElementById("status").textContent = "Failed to open private model: " + err.message;
+			});
+	})();
+	</script>
+</body></html>`
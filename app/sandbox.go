@@ -0,0 +1,40 @@
+package app
+
+import (
+	"errors"
+	"github.com/pflow-dev/pflow-cli/sandbox"
+	"net/http"
+	"strings"
+)
+
+const sandboxStaticPath = "/sandbox/static/"
+
+// LoadSandboxAssets verifies the vendored sandbox assets against their integrity manifest,
+// the sandbox is unavailable until this succeeds
+func (s *Server) LoadSandboxAssets(fsys http.FileSystem) error {
+	if fsys == nil {
+		return errors.New("sandbox: assets are not vendored, run pflow sandbox vendor")
+	}
+	hashes, err := sandbox.Verify(fsys)
+	if err != nil {
+		return err
+	}
+	s.sandboxFiles = http.FileServer(fsys)
+	s.sandboxHashes = hashes
+	s.Logger.Info("sandbox assets verified", "count", len(hashes))
+	return nil
+}
+
+// SandboxAssetHandler serves the verified assets, files not listed in the manifest respond 404
+func (s *Server) SandboxAssetHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, sandboxStaticPath)
+	if _, ok := s.sandboxHashes[name]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+	r = r.Clone(r.Context())
+	r.URL.Path = "/" + name
+	r.URL.RawPath = ""
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	s.sandboxFiles.ServeHTTP(w, r)
+}
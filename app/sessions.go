@@ -0,0 +1,177 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/pflow-dev/go-metamodel/v2/metamodel"
+	"github.com/pflow-dev/pflow-cli/sealed"
+	"github.com/pflow-dev/pflow-cli/session"
+	"net/http"
+	"time"
+)
+
+const (
+	sessionsPath      = "/api/sessions"
+	sessionKeepAlive  = 15 * time.Second
+	maxSessionRequest = 4 << 10
+)
+
+type sessionCreate struct {
+	Cid string `json:"cid"`
+}
+
+type sessionFire struct {
+	Action   string `json:"action"`
+	Multiple int64  `json:"multiple"`
+	Role     string `json:"role"`
+}
+
+func (s *Server) registerSessions() {
+	s.Router.HandleFunc(sessionsPath, s.SessionCreateHandler).Methods(http.MethodPost)
+	s.Router.HandleFunc(sessionsPath+"/{session}", s.SessionHandler).Methods(http.MethodGet)
+	s.Router.HandleFunc(sessionsPath+"/{session}", s.SessionDeleteHandler).Methods(http.MethodDelete)
+	s.Router.HandleFunc(sessionsPath+"/{session}/fire", s.SessionFireHandler).Methods(http.MethodPost)
+	s.Router.HandleFunc(sessionsPath+"/{session}/events", s.SessionEventsHandler).Methods(http.MethodGet)
+}
+
+// sessionModel loads a stored model, private models need the share secret
+func (s *Server) sessionModel(r *http.Request, cid string) (mm metamodel.MetaModel, status int, msg string) {
+	z := s.App.Model.GetByCid(cid)
+	if z.IpfsCid != cid || z.ID == 0 {
+		return nil, http.StatusNotFound, "model not found"
+	}
+	if sealed.Is(z.Base64Zipped) {
+		opened, status, msg := openSealed(r, z)
+		if status != http.StatusOK {
+			return nil, status, msg
+		}
+		z = opened
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			s.unzipFailed(r)
+			mm, status, msg = nil, http.StatusUnprocessableEntity, "stored model cannot be unpacked"
+		}
+	}()
+	mm = metamodel.New()
+	if _, ok := mm.UnpackFromUrl("?z="+z.Base64Zipped, "model.json"); !ok {
+		return nil, http.StatusUnprocessableEntity, "stored model cannot be unpacked"
+	}
+	return mm, http.StatusOK, ""
+}
+
+func (s *Server) SessionCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if ok, msg := s.admitClient(w, r); !ok {
+		apiFail(w, http.StatusTooManyRequests, msg)
+		return
+	}
+	req := sessionCreate{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSessionRequest)).Decode(&req)
+	if err != nil || req.Cid == "" {
+		apiFail(w, http.StatusBadRequest, "expected {\"cid\": \"<model cid>\"}")
+		return
+	}
+	mm, status, msg := s.sessionModel(r, req.Cid)
+	if status != http.StatusOK {
+		apiFail(w, status, msg)
+		return
+	}
+	sess, err := s.sessions.Create(req.Cid, mm)
+	if err != nil {
+		apiFail(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	s.Logger.Info("session created", "session", sess.ID(), "cid", req.Cid)
+	w.Header().Set("Location", link(r, sessionsPath+"/"+sess.ID()))
+	writeJson(w, http.StatusCreated, sess.State())
+}
+
+func (s *Server) lookupSession(w http.ResponseWriter, r *http.Request) (*session.Session, bool) {
+	sess, ok := s.sessions.Get(mux.Vars(r)["session"])
+	if !ok {
+		apiFail(w, http.StatusNotFound, "session not found")
+	}
+	return sess, ok
+}
+
+func (s *Server) SessionHandler(w http.ResponseWriter, r *http.Request) {
+	if sess, ok := s.lookupSession(w, r); ok {
+		writeJson(w, http.StatusOK, sess.State())
+	}
+}
+
+func (s *Server) SessionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if sess, ok := s.lookupSession(w, r); ok {
+		s.sessions.Remove(sess.ID())
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// SessionFireHandler fires a transition for every subscriber, a transition that is not enabled responds 409
+func (s *Server) SessionFireHandler(w http.ResponseWriter, r *http.Request) {
+	sess, ok := s.lookupSession(w, r)
+	if !ok {
+		return
+	}
+	req := sessionFire{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSessionRequest)).Decode(&req)
+	if err != nil || req.Action == "" {
+		apiFail(w, http.StatusBadRequest, "expected {\"action\": \"<transition>\"}")
+		return
+	}
+	st, err := sess.Fire(req.Action, req.Multiple, req.Role)
+	fireErr := &session.FireError{}
+	switch {
+	case errors.As(err, &fireErr):
+		apiFail(w, http.StatusConflict, fireErr.Error())
+	case err != nil:
+		apiFail(w, http.StatusNotFound, "session not found")
+	default:
+		writeJson(w, http.StatusOK, st)
+	}
+}
+
+// SessionEventsHandler streams the session state as server-sent events,
+// the current state is sent first and an end event when the session is removed
+func (s *Server) SessionEventsHandler(w http.ResponseWriter, r *http.Request) {
+	sess, ok := s.lookupSession(w, r)
+	if !ok {
+		return
+	}
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{}) // streams outlive WriteTimeout
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	updates, cancel := sess.Subscribe()
+	defer cancel()
+	keepAlive := time.NewTicker(sessionKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case st, open := <-updates:
+			if !open {
+				_, _ = fmt.Fprint(w, "event: end\ndata: {}\n\n")
+				_ = rc.Flush()
+				return
+			}
+			data, _ := json.Marshal(st)
+			_, err = fmt.Fprintf(w, "id: %d\nevent: state\ndata: %s\n\n", st.Seq, data)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"github.com/pflow-dev/go-metamodel/v2/metamodel"
+	"github.com/pflow-dev/go-metamodel/v2/model"
+	"github.com/pflow-dev/pflow-cli/snippet"
+	"net/http"
+	"time"
+)
+
+// snippetFailureTtl is how long a failed evaluation is served from the cache
+const snippetFailureTtl = 30 * time.Second
+
+// modelOrSnippet looks up a stored model, falling back to a snippet evaluated into the model it declares
+// so /img/ and /src/ render both, ok is false when the snippet failed and a 422 was written
+func (s *Server) modelOrSnippet(w http.ResponseWriter, r *http.Request, cid string) (zblob *model.Zblob, ok bool) {
+	zblob = s.App.Model.GetByCid(cid)
+	if cid == "" || zblob.IpfsCid == cid {
+		return zblob, true
+	}
+	source := s.App.Snippet.GetByCid(cid)
+	if source.IpfsCid != cid {
+		return zblob, true
+	}
+	result, cached := s.cachedSnippet(cid)
+	if !cached {
+		// evaluating costs a worker for up to the timeout, so it counts against the ingest rate limit
+		if allowed, msg := s.admitClient(w, r); !allowed {
+			http.Error(w, msg, http.StatusTooManyRequests)
+			return nil, false
+		}
+		result = s.evalSnippet(r.Context(), source)
+	}
+	if result.err != nil {
+		s.Logger.Info("snippet failed", "cid", cid, "cached", cached, "err", result.err)
+		status := http.StatusUnprocessableEntity
+		if errors.Is(result.err, snippet.ErrHeap) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, result.err.Error(), status)
+		return nil, false
+	}
+	return &model.Zblob{
+		ID:           source.ID,
+		IpfsCid:      cid,
+		Base64Zipped: result.zipped,
+		Title:        source.Title,
+		Description:  source.Description,
+		Keywords:     source.Keywords,
+		CreatedAt:    source.CreatedAt,
+	}, true
+}
+
+// snippetResult is the zipped model.json of a snippet or the reason it failed,
+// failures expire so a snippet that timed out on a busy server is tried again later
+type snippetResult struct {
+	zipped  string
+	err     error
+	expires time.Time // zero for results that never expire
+}
+
+func snippetKey(cid string) string {
+	return "snippet:" + cid
+}
+
+func (s *Server) cachedSnippet(cid string) (snippetResult, bool) {
+	if s.renderCache == nil {
+		return snippetResult{}, false
+	}
+	v, ok := s.renderCache.Get(snippetKey(cid))
+	if !ok {
+		return snippetResult{}, false
+	}
+	result := v.(snippetResult)
+	if !result.expires.IsZero() && time.Now().After(result.expires) {
+		s.renderCache.Remove(snippetKey(cid))
+		return snippetResult{}, false
+	}
+	return result, true
+}
+
+// evalSnippet evaluates a snippet and caches the result by cid, failures for snippetFailureTtl
+// so a snippet that always times out cannot hold a worker on every request
+func (s *Server) evalSnippet(ctx context.Context, z *model.Zblob) snippetResult {
+	result := snippetResult{}
+	source, ok := unzipSource(z.Base64Zipped)
+	if !ok {
+		result.err = errors.New("snippet: invalid declaration.js zip")
+	} else {
+		var mm metamodel.MetaModel
+		mm, result.err = snippet.Eval(ctx, source, snippet.Limits{
+			Timeout: s.Options.SnippetTimeout,
+			Memory:  uint64(s.Options.SnippetMemory),
+		})
+		if result.err == nil {
+			zipUrl, _ := mm.ZipUrl()
+			result.zipped = zipUrl[3:]
+		}
+	}
+	if ctx.Err() != nil || errors.Is(result.err, snippet.ErrHeap) {
+		return result // the client went away or the server was busy, the snippet is not to blame
+	}
+	if result.err != nil {
+		result.expires = time.Now().Add(snippetFailureTtl)
+	}
+	if s.renderCache != nil {
+		key := snippetKey(z.IpfsCid)
+		s.renderCache.Add(key, result, int64(len(key)+len(result.zipped)))
+	}
+	return result
+}
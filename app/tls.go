@@ -0,0 +1,180 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// certLoader holds the serving certificate so it can be swapped without restarting
+type certLoader struct {
+	certFile   string
+	keyFile    string
+	selfSigned bool
+	hosts      []string
+	mu         sync.RWMutex
+	cert       *tls.Certificate
+}
+
+func (s *Server) tlsEnabled() bool {
+	return s.Options.TLSCert != "" || s.Options.TLSSelfSigned
+}
+
+// scheme is used to build absolute links to this server
+func (s *Server) scheme() string {
+	if s.tlsEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+func (s *Server) newCertLoader() *certLoader {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if s.Options.Host != "" && s.Options.Host != "0.0.0.0" && s.Options.Host != "::" {
+		hosts = append(hosts, s.Options.Host)
+	}
+	if u, err := url.Parse(s.Options.Url); err == nil && u.Hostname() != "" {
+		hosts = append(hosts, u.Hostname())
+	}
+	return &certLoader{
+		certFile:   s.Options.TLSCert,
+		keyFile:    s.Options.TLSKey,
+		selfSigned: s.Options.TLSSelfSigned,
+		hosts:      hosts,
+	}
+}
+
+// load reads the certificate files, generating a self-signed pair first when enabled
+// without files a self-signed certificate is only kept in memory
+func (c *certLoader) load() error {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case c.certFile == "" && c.selfSigned:
+		c.mu.RLock()
+		loaded := c.cert != nil
+		c.mu.RUnlock()
+		if loaded {
+			return nil
+		}
+		certPem, keyPem, genErr := selfSignedCert(c.hosts)
+		if genErr != nil {
+			return genErr
+		}
+		cert, err = tls.X509KeyPair(certPem, keyPem)
+	case c.certFile == "" || c.keyFile == "":
+		return errors.New("tls: both a certificate and a key file are required")
+	default:
+		if c.selfSigned {
+			err = writeSelfSigned(c.certFile, c.keyFile, c.hosts)
+			if err != nil {
+				return err
+			}
+		}
+		cert, err = tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil {
+		return nil, errors.New("tls: no certificate loaded")
+	}
+	return c.cert, nil
+}
+
+// writeSelfSigned creates a certificate and key at the given paths unless the certificate already exists
+func writeSelfSigned(certFile, keyFile string, hosts []string) error {
+	if _, err := os.Stat(certFile); err == nil {
+		return nil
+	}
+	certPem, keyPem, err := selfSignedCert(hosts)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(keyFile, keyPem, 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, certPem, 0644)
+}
+
+func selfSignedCert(hosts []string) (certPem []byte, keyPem []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"pflow self-signed"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPem, keyPem, nil
+}
+
+// ReloadCertificates re-reads the certificate files, the previous certificate is kept on error
+func (s *Server) ReloadCertificates() error {
+	if !s.tlsEnabled() {
+		return nil
+	}
+	return s.certs.load()
+}
+
+// redirectHandler sends plain http requests to the https listener
+func (s *Server) redirectHandler(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if s.Options.Port != "443" {
+		host = net.JoinHostPort(host, s.Options.Port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
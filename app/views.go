@@ -0,0 +1,132 @@
+package app
+
+import (
+	"github.com/pflow-dev/go-metamodel/v2/model"
+	"github.com/pflow-dev/pflow-cli/storage"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	viewQueue = 4096 // views waiting to be written, more are dropped
+	viewBatch = 256  // views written per transaction
+	viewDelay = 100 * time.Millisecond
+)
+
+// viewRecorder writes page view events off the request path, views are collected for viewDelay
+// and written in one transaction, a full queue drops views and counts them
+type viewRecorder struct {
+	queue   chan storage.Event
+	dropped atomic.Uint64
+	start   sync.Once
+	stop    sync.Once
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func newViewRecorder() *viewRecorder {
+	return &viewRecorder{
+		queue:   make(chan storage.Event, viewQueue),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// viewEvent logs a page view and queues it for the journal when r may write,
+// create events are recorded synchronously by recordEvent instead
+func (s *Server) viewEvent(eventType string, m *model.Zblob, r *http.Request) {
+	params := map[string]interface{}{
+		"id":       m.ID,
+		"cid":      m.IpfsCid,
+		"referrer": r.Header.Get("Referer"),
+	}
+	s.event(eventType, params, false)
+	if !s.canWrite(r) {
+		return
+	}
+	v := s.views
+	v.start.Do(func() { go s.recordViews() })
+	select {
+	case v.queue <- storage.Event{Type: eventType, Params: params, CreatedAt: time.Now().UTC()}:
+	default:
+		v.dropped.Add(1)
+	}
+}
+
+func (s *Server) recordViews() {
+	v := s.views
+	defer close(v.done)
+	batch := make([]storage.Event, 0, viewBatch)
+	for {
+		select {
+		case evt := <-v.queue:
+			batch = append(batch[:0], evt)
+		case <-v.closing:
+			s.flushViews(batch[:0])
+			return
+		}
+		s.writeViews(s.collectViews(batch))
+	}
+}
+
+// collectViews adds views to batch until it is full, viewDelay passed or the server shuts down
+func (s *Server) collectViews(batch []storage.Event) []storage.Event {
+	wait := time.NewTimer(viewDelay)
+	defer wait.Stop()
+	for len(batch) < viewBatch {
+		select {
+		case evt := <-s.views.queue:
+			batch = append(batch, evt)
+		case <-wait.C:
+			return batch
+		case <-s.views.closing:
+			return batch
+		}
+	}
+	return batch
+}
+
+// takeViews adds the views already waiting to batch without blocking, it is used to drain the queue
+func (s *Server) takeViews(batch []storage.Event) []storage.Event {
+	for len(batch) < viewBatch {
+		select {
+		case evt := <-s.views.queue:
+			batch = append(batch, evt)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// flushViews writes everything still queued when the server shuts down
+func (s *Server) flushViews(batch []storage.Event) {
+	for {
+		batch = s.takeViews(batch[:0])
+		if len(batch) == 0 {
+			return
+		}
+		s.writeViews(batch)
+	}
+}
+
+func (s *Server) writeViews(batch []storage.Event) {
+	err := s.Store.Events.AppendBatch(batch)
+	if err != nil {
+		s.Logger.Error("failed to record views", "count", len(batch), "err", err)
+		return
+	}
+	for _, evt := range batch {
+		s.notifyWebhooks(evt)
+	}
+}
+
+// stopViews writes the queued views and stops the recorder, views after this are dropped
+func (s *Server) stopViews() {
+	v := s.views
+	v.start.Do(func() { close(v.done) })
+	v.stop.Do(func() { close(v.closing) })
+	<-v.done
+}
@@ -0,0 +1,220 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pflow-dev/pflow-cli/storage"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SignatureHeader        = "X-Pflow-Signature"
+	defaultWebhookAttempts = 8 // used when Options.WebhookAttempts is not set, likewise the timeout and backoff
+	defaultWebhookTimeout  = 10 * time.Second
+	defaultWebhookBackoff  = 10 * time.Second
+	webhookBatch           = 32
+	maxWebhookBackoff      = time.Hour
+	maxWebhookPoll         = time.Second
+)
+
+// EventTypes are the events a webhook can subscribe to
+var EventTypes = []string{
+	"modelUnzipped", "sandboxUnzipped",
+	"modelCreated", "modelUpdated", "modelDeleted",
+	"snippetCreated", "snippetUpdated", "snippetDeleted",
+	"modelViewed", "modelEmbedded", "svgRendered", "pngRendered", "jsonFetched",
+}
+
+// ValidateWebhook checks that rawUrl is an absolute http or https url and that every event type exists
+func ValidateWebhook(rawUrl string, events []string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook: %s is not an http or https url", rawUrl)
+	}
+	for _, e := range events {
+		if !slices.Contains(EventTypes, e) {
+			return fmt.Errorf("webhook: unknown event type %s, expected one of %s", e, strings.Join(EventTypes, ","))
+		}
+	}
+	return nil
+}
+
+// Sign returns the signature header value for body, receivers compare it with hmac.Equal
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDispatcher delivers queued events in the background,
+// the queue lives in sqlite so pending deliveries survive a restart
+type webhookDispatcher struct {
+	client *http.Client
+	wake   chan struct{}
+	start  sync.Once
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newWebhookDispatcher(timeout time.Duration) *webhookDispatcher {
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout // a hanging receiver would otherwise stall every delivery
+	}
+	return &webhookDispatcher{
+		client: &http.Client{Timeout: timeout},
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// startWebhooks runs the dispatcher until stopWebhooks is called
+func (s *Server) startWebhooks() {
+	d := s.webhooks
+	d.start.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		d.cancel = cancel
+		go func() {
+			defer close(d.done)
+			s.runWebhooks(ctx)
+		}()
+	})
+}
+
+// stopWebhooks waits for an attempt in progress, it is not recorded if it was cut short
+func (s *Server) stopWebhooks() {
+	d := s.webhooks
+	d.start.Do(func() { close(d.done) })
+	if d.cancel != nil {
+		d.cancel()
+	}
+	<-d.done
+}
+
+// notifyWebhooks queues evt for subscribed webhooks and wakes the dispatcher
+func (s *Server) notifyWebhooks(evt storage.Event) {
+	n, err := s.Store.Webhooks.Enqueue(evt)
+	if err != nil {
+		s.Logger.Error("failed to queue webhooks", "type", evt.Type, "err", err)
+		return
+	}
+	if n > 0 {
+		select {
+		case s.webhooks.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *Server) runWebhooks(ctx context.Context) {
+	poll := maxWebhookPoll
+	if s.Options.WebhookBackoff > 0 {
+		poll = min(poll, s.Options.WebhookBackoff)
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		s.deliverDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.webhooks.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		due, err := s.Store.Webhooks.Due(time.Now(), webhookBatch)
+		if err != nil {
+			s.Logger.Error("failed to load webhook deliveries", "err", err)
+			return
+		}
+		for _, d := range due {
+			s.deliver(ctx, d)
+		}
+		if len(due) < webhookBatch {
+			return
+		}
+	}
+}
+
+// webhookBackoff doubles the delay after each failed attempt
+func webhookBackoff(base time.Duration, attempts int64) time.Duration {
+	delay := base
+	for i := int64(1); i < attempts && delay < maxWebhookBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxWebhookBackoff)
+}
+
+func (s *Server) deliver(ctx context.Context, d storage.Delivery) {
+	code, err := s.post(ctx, d)
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil {
+		err = s.Store.Webhooks.Delivered(d.ID, code)
+		if err != nil {
+			s.Logger.Error("failed to record webhook delivery", "delivery", d.ID, "err", err)
+		}
+		return
+	}
+	attempts := d.Attempts + 1
+	limit := s.Options.WebhookAttempts
+	if limit <= 0 {
+		limit = defaultWebhookAttempts
+	}
+	dead := attempts >= int64(limit)
+	backoff := s.Options.WebhookBackoff
+	if backoff <= 0 {
+		backoff = defaultWebhookBackoff
+	}
+	next := time.Now().Add(webhookBackoff(backoff, attempts))
+	if dead {
+		s.Logger.Error("webhook delivery dead-lettered", "delivery", d.ID, "url", d.Url, "attempts", attempts, "err", err)
+	} else {
+		s.Logger.Warn("webhook delivery failed", "delivery", d.ID, "url", d.Url, "attempts", attempts, "retry", next, "err", err)
+	}
+	err = s.Store.Webhooks.Failed(d.ID, code, err.Error(), next, dead)
+	if err != nil {
+		s.Logger.Error("failed to record webhook delivery", "delivery", d.ID, "err", err)
+	}
+}
+
+// post sends one attempt, any response outside 2xx is an error
+func (s *Server) post(ctx context.Context, d storage.Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Url, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pflow-webhook")
+	req.Header.Set("X-Pflow-Event", d.EventType)
+	req.Header.Set("X-Pflow-Delivery", strconv.FormatInt(d.ID, 10))
+	req.Header.Set(SignatureHeader, Sign(d.Secret, d.Payload))
+	res, err := s.webhooks.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
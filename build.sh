@@ -9,6 +9,16 @@ rm -rf ./public/p
 rm -rf ./public
 mkdir ./public
 mv ../pflow-editor/build ./public/p
+# the index page reads its script and style tags from the build's asset manifest
+if [[ ! -f ./public/p/asset-manifest.json ]] ; then
+    echo "missing ./public/p/asset-manifest.json, check the pflow-editor build"
+    exit 1
+fi;
+# sandbox scripts are served from the binary, pinned in sandbox/sandbox.go
+if ! go run . sandbox vendor -dir ./public/sandbox/static ; then
+    echo "failed to vendor the sandbox assets, check the pins in sandbox/sandbox.go"
+    exit 1
+fi;
 # NOTE: must have rice tool installed
 if [[ -x rice ]] ; then
     echo "found rice: $(which rice)" 
@@ -18,4 +28,3 @@ else
 fi;
 rice embed-go
 go build #-ldflags "-s"
-echo "remember to update the script tag main.<build>.js ./app/app.go"
@@ -0,0 +1,44 @@
+package cache
+
+import (
+	"github.com/pflow-dev/go-metamodel/v2/model"
+	"github.com/pflow-dev/go-metamodel/v2/server"
+)
+
+// Blobs is a read-through cache in front of a BlobAccessor
+// rows are addressed by content hash so a cached row never goes stale
+type Blobs struct {
+	server.BlobAccessor
+	lru *LRU
+}
+
+func NewBlobs(accessor server.BlobAccessor, lru *LRU) Blobs {
+	return Blobs{BlobAccessor: accessor, lru: lru}
+}
+
+func (b Blobs) GetByCid(cid string) *model.Zblob {
+	if v, ok := b.lru.Get(cid); ok {
+		return v.(*model.Zblob)
+	}
+	zblob := b.BlobAccessor.GetByCid(cid)
+	if zblob.IpfsCid == cid {
+		b.lru.Add(cid, zblob, blobSize(zblob))
+	}
+	return zblob
+}
+
+// Forget drops a cached row, used when a row is deleted or its metadata changes
+func (b Blobs) Forget(cid string) {
+	if b.lru != nil {
+		b.lru.Remove(cid)
+	}
+}
+
+func (b Blobs) Stats() Stats {
+	return b.lru.Stats()
+}
+
+func blobSize(z *model.Zblob) int64 {
+	const overhead = 128
+	return int64(overhead + len(z.IpfsCid) + len(z.Base64Zipped) + len(z.Title) + len(z.Description) + len(z.Keywords) + len(z.Referer))
+}
@@ -0,0 +1,24 @@
+package cache
+
+import "testing"
+
+func TestEviction(t *testing.T) {
+	c := New(2, 10)
+	c.Add("a", "a", 4)
+	c.Add("b", "b", 4)
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	c.Add("c", "c", 4) // exceeds both limits, evicts least recently used b
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("expected b to be evicted")
+	}
+	c.Add("big", "big", 11) // larger than the whole cache, never stored
+	if _, ok := c.Get("big"); ok {
+		t.Fatal("expected oversized entry to be skipped")
+	}
+	stats := c.Stats()
+	if stats.Entries != 2 || stats.Bytes != 8 || stats.Evictions != 1 || stats.Hits != 1 || stats.Misses != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
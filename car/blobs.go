@@ -0,0 +1,189 @@
+package car
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"github.com/pflow-dev/go-metamodel/v2/codec"
+	"github.com/pflow-dev/go-metamodel/v2/metamodel"
+	"github.com/pflow-dev/go-metamodel/v2/model"
+	"github.com/pflow-dev/go-metamodel/v2/server"
+	"github.com/pflow-dev/pflow-cli/sealed"
+	"io"
+)
+
+// Entry holds the metadata for one model or snippet block
+type Entry struct {
+	Cid         string `json:"cid"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Keywords    string `json:"keywords"`
+}
+
+// Index is stored as the root block of every exported archive
+type Index struct {
+	Models   []Entry `json:"models"`
+	Snippets []Entry `json:"snippets"`
+}
+
+// modelBlock returns the bytes that hash to a model cid: the json encoded zip
+func modelBlock(z *model.Zblob) []byte {
+	return codec.Marshal(z.Base64Zipped)
+}
+
+// snippetBlock returns the bytes that hash to a snippet cid: the json encoded source
+func snippetBlock(z *model.Zblob) ([]byte, bool) {
+	source, ok := metamodel.UnzipUrl("?z="+z.Base64Zipped, "declaration.js")
+	if !ok {
+		return nil, false
+	}
+	return codec.Marshal(source), true
+}
+
+func toBlock(ipfsCid string, data []byte) (Block, bool) {
+	c, err := cid.Decode(ipfsCid)
+	if err != nil {
+		return Block{}, false
+	}
+	return Block{Cid: c, Data: data}, verify(Block{Cid: c, Data: data})
+}
+
+func verify(b Block) bool {
+	sum, err := b.Cid.Prefix().Sum(b.Data)
+	return err == nil && sum.Equals(b.Cid)
+}
+
+func toEntry(z *model.Zblob) Entry {
+	return Entry{
+		Cid:         z.IpfsCid,
+		Title:       z.Title,
+		Description: z.Description,
+		Keywords:    z.Keywords,
+	}
+}
+
+// Export writes models and snippets to a CARv1 archive rooted at an Index block
+// blobs whose stored cid does not match their content are skipped and returned
+func Export(w io.Writer, models []*model.Zblob, snippets []*model.Zblob) (skipped []string, err error) {
+	index := Index{Models: []Entry{}, Snippets: []Entry{}}
+	blocks := []Block{}
+	for _, z := range models {
+		b, ok := toBlock(z.IpfsCid, modelBlock(z))
+		if !ok {
+			skipped = append(skipped, z.IpfsCid)
+			continue
+		}
+		blocks = append(blocks, b)
+		index.Models = append(index.Models, toEntry(z))
+	}
+	for _, z := range snippets {
+		data, ok := snippetBlock(z)
+		var b Block
+		if ok {
+			b, ok = toBlock(z.IpfsCid, data)
+		}
+		if !ok {
+			skipped = append(skipped, z.IpfsCid)
+			continue
+		}
+		blocks = append(blocks, b)
+		index.Snippets = append(index.Snippets, toEntry(z))
+	}
+	indexData := codec.Marshal(index)
+	root := Block{Cid: codec.ToOid(indexData).Cid, Data: indexData}
+	cw, err := NewWriter(w, root.Cid)
+	if err != nil {
+		return skipped, err
+	}
+	for _, b := range append([]Block{root}, blocks...) {
+		err = cw.Write(b)
+		if err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, nil
+}
+
+// Import reads an archive produced by Export and stores every indexed block
+func Import(r io.Reader, store server.Storage, referrer string) (index Index, err error) {
+	cr, err := NewReader(r)
+	if err != nil {
+		return index, err
+	}
+	if len(cr.Roots) != 1 {
+		return index, fmt.Errorf("car: expected 1 root, found %d", len(cr.Roots))
+	}
+	blocks := map[string][]byte{}
+	for {
+		b, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return index, err
+		}
+		if !verify(b) {
+			return index, fmt.Errorf("car: block %s does not match its cid", b.Cid)
+		}
+		blocks[b.Cid.KeyString()] = b.Data
+	}
+	indexData, ok := blocks[cr.Roots[0].KeyString()]
+	if !ok {
+		return index, fmt.Errorf("car: missing root block %s", cr.Roots[0])
+	}
+	err = json.Unmarshal(indexData, &index)
+	if err != nil {
+		return index, fmt.Errorf("car: bad index block: %w", err)
+	}
+	for _, e := range index.Models {
+		zipped, err := blockString(blocks, e.Cid)
+		if err != nil {
+			return index, err
+		}
+		if !sealed.Is(zipped) && !isModel(zipped) {
+			return index, fmt.Errorf("car: block %s is not a model", e.Cid)
+		}
+		_, err = store.Model.Create(e.Cid, zipped, e.Title, e.Description, e.Keywords, referrer)
+		if err != nil {
+			return index, err
+		}
+	}
+	for _, e := range index.Snippets {
+		source, err := blockString(blocks, e.Cid)
+		if err != nil {
+			return index, err
+		}
+		zipped, _ := metamodel.ToEncodedZip([]byte(source), "declaration.js")
+		_, err = store.Snippet.Create(e.Cid, zipped, e.Title, e.Description, e.Keywords, referrer)
+		if err != nil {
+			return index, err
+		}
+	}
+	return index, nil
+}
+
+func blockString(blocks map[string][]byte, ipfsCid string) (s string, err error) {
+	c, err := cid.Decode(ipfsCid)
+	if err != nil {
+		return s, fmt.Errorf("car: bad cid %s: %w", ipfsCid, err)
+	}
+	data, ok := blocks[c.KeyString()]
+	if !ok {
+		return s, fmt.Errorf("car: missing block %s", ipfsCid)
+	}
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return s, fmt.Errorf("car: block %s is not a json string: %w", ipfsCid, err)
+	}
+	return s, nil
+}
+
+func isModel(zipped string) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	_, ok = metamodel.UnzipUrl("?z="+zipped, "model.json")
+	return ok
+}
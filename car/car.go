@@ -0,0 +1,269 @@
+package car
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"io"
+)
+
+// CARv1 archives are a varint framed dag-cbor header followed by
+// varint framed sections of cid bytes + block data
+// see: https://ipld.io/specs/transport/car/carv1/
+
+const (
+	version         = 1
+	maxSectionBytes = 32 << 20
+	cidTag          = 42
+)
+
+var (
+	ErrBadHeader  = errors.New("car: malformed header")
+	ErrBadVersion = errors.New("car: unsupported version")
+	ErrTooLarge   = errors.New("car: section exceeds size limit")
+)
+
+// Block is a single content addressed entry in a CAR file
+type Block struct {
+	Cid  cid.Cid
+	Data []byte
+}
+
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter writes the CAR header naming the given roots
+func NewWriter(w io.Writer, roots ...cid.Cid) (*Writer, error) {
+	cw := &Writer{w: w}
+	return cw, cw.writeSection(encodeHeader(roots))
+}
+
+func (cw *Writer) Write(b Block) error {
+	return cw.writeSection(b.Cid.Bytes(), b.Data)
+}
+
+func (cw *Writer) writeSection(parts ...[]byte) error {
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+	_, err := cw.w.Write(binary.AppendUvarint(nil, uint64(size)))
+	if err != nil {
+		return err
+	}
+	for _, p := range parts {
+		_, err = cw.w.Write(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Reader struct {
+	r     *bufio.Reader
+	Roots []cid.Cid
+}
+
+// NewReader reads the CAR header, leaving the reader positioned at the first block
+func NewReader(r io.Reader) (*Reader, error) {
+	cr := &Reader{r: bufio.NewReader(r)}
+	header, err := cr.readSection()
+	if err != nil {
+		if err == io.EOF {
+			return nil, ErrBadHeader
+		}
+		return nil, err
+	}
+	cr.Roots, err = decodeHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Next returns the next block, or io.EOF once the archive is exhausted
+func (cr *Reader) Next() (Block, error) {
+	section, err := cr.readSection()
+	if err != nil {
+		return Block{}, err
+	}
+	n, c, err := cid.CidFromBytes(section)
+	if err != nil {
+		return Block{}, fmt.Errorf("car: bad block cid: %w", err)
+	}
+	return Block{Cid: c, Data: section[n:]}, nil
+}
+
+func (cr *Reader) readSection() ([]byte, error) {
+	size, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxSectionBytes {
+		return nil, ErrTooLarge
+	}
+	buf := make([]byte, size)
+	_, err = io.ReadFull(cr.r, buf)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// encodeHeader emits the dag-cbor map {"roots": [...], "version": 1}
+// keys are written in dag-cbor canonical order (shortest first)
+func encodeHeader(roots []cid.Cid) []byte {
+	out := []byte{0xa2}
+	out = appendCborText(out, "roots")
+	out = appendCborHead(out, 4, uint64(len(roots)))
+	for _, root := range roots {
+		out = appendCborHead(out, 6, cidTag)
+		// tag 42 byte strings carry a leading multibase identity prefix
+		data := append([]byte{0x00}, root.Bytes()...)
+		out = appendCborHead(out, 2, uint64(len(data)))
+		out = append(out, data...)
+	}
+	out = appendCborText(out, "version")
+	out = appendCborHead(out, 0, version)
+	return out
+}
+
+func appendCborText(out []byte, s string) []byte {
+	out = appendCborHead(out, 3, uint64(len(s)))
+	return append(out, s...)
+}
+
+func appendCborHead(out []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(out, major|byte(n))
+	case n <= 0xff:
+		return append(out, major|24, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(out, major|25), uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(out, major|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(out, major|27), n)
+	}
+}
+
+// cborReader decodes just enough cbor to read a CARv1 header
+type cborReader struct {
+	data []byte
+	pos  int
+}
+
+func (c *cborReader) head() (major byte, n uint64, err error) {
+	if c.pos >= len(c.data) {
+		return 0, 0, ErrBadHeader
+	}
+	b := c.data[c.pos]
+	c.pos++
+	major, info := b>>5, b&0x1f
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	width := 0
+	switch info {
+	case 24:
+		width = 1
+	case 25:
+		width = 2
+	case 26:
+		width = 4
+	case 27:
+		width = 8
+	default:
+		return 0, 0, ErrBadHeader
+	}
+	if c.pos+width > len(c.data) {
+		return 0, 0, ErrBadHeader
+	}
+	for _, v := range c.data[c.pos : c.pos+width] {
+		n = n<<8 | uint64(v)
+	}
+	c.pos += width
+	return major, n, nil
+}
+
+func (c *cborReader) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(c.data)-c.pos) {
+		return nil, ErrBadHeader
+	}
+	out := c.data[c.pos : c.pos+int(n)]
+	c.pos += int(n)
+	return out, nil
+}
+
+func decodeHeader(data []byte) (roots []cid.Cid, err error) {
+	c := &cborReader{data: data}
+	major, entries, err := c.head()
+	if err != nil || major != 5 {
+		return nil, ErrBadHeader
+	}
+	foundVersion := false
+	for i := uint64(0); i < entries; i++ {
+		major, n, err := c.head()
+		if err != nil || major != 3 {
+			return nil, ErrBadHeader
+		}
+		key, err := c.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		switch string(key) {
+		case "version":
+			major, v, err := c.head()
+			if err != nil || major != 0 {
+				return nil, ErrBadHeader
+			}
+			if v != version {
+				return nil, ErrBadVersion
+			}
+			foundVersion = true
+		case "roots":
+			major, count, err := c.head()
+			if err != nil || major != 4 {
+				return nil, ErrBadHeader
+			}
+			for j := uint64(0); j < count; j++ {
+				root, err := c.cid()
+				if err != nil {
+					return nil, err
+				}
+				roots = append(roots, root)
+			}
+		default:
+			return nil, ErrBadHeader
+		}
+	}
+	if !foundVersion {
+		return nil, ErrBadHeader
+	}
+	return roots, nil
+}
+
+func (c *cborReader) cid() (cid.Cid, error) {
+	major, tag, err := c.head()
+	if err != nil || major != 6 || tag != cidTag {
+		return cid.Undef, ErrBadHeader
+	}
+	major, n, err := c.head()
+	if err != nil || major != 2 || n == 0 {
+		return cid.Undef, ErrBadHeader
+	}
+	data, err := c.bytes(n)
+	if err != nil || data[0] != 0x00 {
+		return cid.Undef, ErrBadHeader
+	}
+	return cid.Cast(data[1:])
+}
@@ -0,0 +1,60 @@
+package car
+
+import (
+	"bytes"
+	"github.com/pflow-dev/go-metamodel/v2/model"
+	"github.com/pflow-dev/go-metamodel/v2/server"
+	. "github.com/pflow-dev/pflow-cli/internal/examples"
+	"github.com/pflow-dev/pflow-cli/storage"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	src := storage.New(storage.ResetDb(filepath.Join(t.TempDir(), "src.db")))
+	m := InhibitorTest
+	_, err := src.Model.Create(m.IpfsCid, m.Base64Zipped, m.Title, m.Description, m.Keywords, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	skipped, err := Export(buf, []*model.Zblob{src.Model.GetByCid(m.IpfsCid), &TicTacToe}, []*model.Zblob{storage.EmptySnippet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0] != TicTacToe.IpfsCid {
+		t.Fatalf("expected legacy TicTacToe cid to be skipped, got %v", skipped)
+	}
+
+	dst := storage.New(storage.ResetDb(filepath.Join(t.TempDir(), "dst.db")))
+	index, err := Import(bytes.NewReader(buf.Bytes()), server.Storage{Model: dst.Model, Snippet: dst.Snippet}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Models) != 1 || len(index.Snippets) != 1 {
+		t.Fatalf("unexpected index: %+v", index)
+	}
+	found := dst.Model.GetByCid(m.IpfsCid)
+	if found.IpfsCid != m.IpfsCid || found.Base64Zipped != m.Base64Zipped || found.Title != m.Title {
+		t.Errorf("imported model mismatch: %+v", found)
+	}
+	if dst.Snippet.GetByCid(storage.EmptySnippet.IpfsCid).ID == 0 {
+		t.Errorf("snippet not imported")
+	}
+}
+
+func TestRejectsTamperedBlock(t *testing.T) {
+	buf := new(bytes.Buffer)
+	_, err := Export(buf, []*model.Zblob{InhibitorTest.Zblob}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	data[len(data)-2] ^= 0xff
+	dst := storage.New(storage.ResetDb(filepath.Join(t.TempDir(), "dst.db")))
+	_, err = Import(bytes.NewReader(data), server.Storage{Model: dst.Model, Snippet: dst.Snippet}, "test")
+	if err == nil {
+		t.Fatal("expected tampered block to be rejected")
+	}
+}
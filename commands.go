@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pflow-dev/go-metamodel/v2/codec"
+	"github.com/pflow-dev/go-metamodel/v2/image"
+	"github.com/pflow-dev/go-metamodel/v2/metamodel"
+	"github.com/pflow-dev/go-metamodel/v2/model"
+	"github.com/pflow-dev/go-metamodel/v2/server"
+	"github.com/pflow-dev/pflow-cli/app"
+	"github.com/pflow-dev/pflow-cli/car"
+	"github.com/pflow-dev/pflow-cli/raster"
+	"github.com/pflow-dev/pflow-cli/sandbox"
+	"github.com/pflow-dev/pflow-cli/sealed"
+	"github.com/pflow-dev/pflow-cli/snippet"
+	"github.com/pflow-dev/pflow-cli/storage"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	usage = `usage: pflow [command]
+
+with no command pflow starts the web server
+
+commands:
+  car export [-o file.car] [cid...]  export models and snippets to a CARv1 archive
+  car import file.car                import models and snippets from a CARv1 archive
+  events tail [-type t] [-n 10]      print recent events and follow the journal
+  private create [-secret s] file    store model.json encrypted and print its share link
+  render <cid|model.json> [-o out.png] [-width w] [-state [1,0]]
+                                     render a model as png, or svg when -o ends in .svg
+  sandbox pin                        print the hashes the cdn serves, to review before pinning them
+  sandbox vendor [-dir d]            download the sandbox assets, failing if one does not match its pin
+  sandbox verify [-dir d]            check vendored sandbox assets against the pinned hashes
+  snippet run <cid|declaration.js> [-o model.json] [-timeout 1s]
+                                     evaluate a snippet and print the model.json it declares
+  token create [-name n]             create an api token for write requests
+  token list                         list active api tokens
+  token revoke <id|name>             revoke api tokens
+  webhook add [-events a,b] url      register a webhook and print its signing secret
+  webhook list                       list active webhooks
+  webhook remove <id>                stop deliveries to a webhook
+  webhook log [-status s] [-n 20]    print recent deliveries, newest first
+  webhook retry <delivery id>        queue a dead-lettered delivery again
+`
+	listPageSize = 100
+)
+
+func runCommand(command string, args []string) {
+	switch command {
+	case "car":
+		carCommand(args)
+	case "events":
+		eventsCommand(args)
+	case "private":
+		privateCommand(args)
+	case "render":
+		renderCommand(args)
+	case "sandbox":
+		sandboxCommand(args)
+	case "snippet":
+		snippetCommand(args)
+	case "token":
+		tokenCommand(args)
+	case "webhook":
+		webhookCommand(args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		fail(fmt.Errorf("unknown command: %s\n%s", command, usage))
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func openStore() *storage.Storage {
+	return storage.New(storage.ResetDb(options.DbPath))
+}
+
+func carCommand(args []string) {
+	if len(args) == 0 {
+		fail(fmt.Errorf("missing car subcommand\n%s", usage))
+	}
+	switch args[0] {
+	case "export":
+		carExport(args[1:])
+	case "import":
+		carImport(args[1:])
+	default:
+		fail(fmt.Errorf("unknown car subcommand: %s\n%s", args[0], usage))
+	}
+}
+
+func carExport(args []string) {
+	flags := flag.NewFlagSet("car export", flag.ExitOnError)
+	outPath := flags.String("o", "", "output file (default stdout)")
+	_ = flags.Parse(args)
+
+	store := openStore()
+	var models, snippets []*model.Zblob
+	if flags.NArg() == 0 {
+		models = listAll(store.Model.List)
+		snippets = listAll(store.Snippet.List)
+	}
+	for _, cid := range flags.Args() {
+		if m := store.Model.GetByCid(cid); m.IpfsCid == cid {
+			models = append(models, m)
+		} else if sn := store.Snippet.GetByCid(cid); sn.IpfsCid == cid {
+			snippets = append(snippets, sn)
+		} else {
+			fail(fmt.Errorf("cid not found: %s", cid))
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			fail(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	skipped, err := car.Export(out, models, snippets)
+	if err != nil {
+		fail(err)
+	}
+	for _, cid := range skipped {
+		fmt.Fprintf(os.Stderr, "skipped %s: stored cid does not match content\n", cid)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d blocks\n", len(models)+len(snippets)-len(skipped))
+}
+
+func carImport(args []string) {
+	if len(args) != 1 {
+		fail(fmt.Errorf("usage: pflow car import file.car"))
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		fail(err)
+	}
+	defer f.Close()
+
+	store := openStore()
+	index, err := car.Import(f, server.Storage{
+		Model:   store.Model,
+		Snippet: store.Snippet,
+	}, "car:"+args[0])
+	if err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "imported %d models, %d snippets\n", len(index.Models), len(index.Snippets))
+}
+
+func listAll(list func(offset, limit int64) []*model.Zblob) []*model.Zblob {
+	all := []*model.Zblob{}
+	for offset := int64(0); ; offset += listPageSize {
+		page := list(offset, listPageSize)
+		all = append(all, page...)
+		if len(page) < listPageSize {
+			return all
+		}
+	}
+}
+
+func eventsCommand(args []string) {
+	if len(args) == 0 || args[0] != "tail" {
+		fail(fmt.Errorf("usage: pflow events tail [-type t] [-n 10] [-follow=false]"))
+	}
+	flags := flag.NewFlagSet("events tail", flag.ExitOnError)
+	eventType := flags.String("type", "", "only show events of this type")
+	count := flags.Int64("n", 10, "number of past events to show")
+	follow := flags.Bool("follow", true, "keep polling for new events")
+	interval := flags.Duration("interval", time.Second, "polling interval")
+	_ = flags.Parse(args[1:])
+
+	store := openStore()
+	out := json.NewEncoder(os.Stdout)
+	query := storage.EventQuery{Type: *eventType, Limit: *count, Newest: true}
+	for {
+		events, err := store.Events.Query(query)
+		if err != nil {
+			fail(err)
+		}
+		for _, evt := range events {
+			_ = out.Encode(evt)
+			query.AfterId = evt.ID
+		}
+		if !*follow {
+			return
+		}
+		query.Limit, query.Newest = 0, false
+		time.Sleep(*interval)
+	}
+}
+
+func privateCommand(args []string) {
+	if len(args) == 0 || args[0] != "create" {
+		fail(fmt.Errorf("usage: pflow private create [-secret s] [-title t] model.json"))
+	}
+	flags := flag.NewFlagSet("private create", flag.ExitOnError)
+	secret := flags.String("secret", "", "share secret (default random)")
+	title := flags.String("title", "Untitled", "model title")
+	description := flags.String("description", "", "model description")
+	_ = flags.Parse(args[1:])
+	if flags.NArg() != 1 {
+		fail(fmt.Errorf("usage: pflow private create [-secret s] [-title t] model.json"))
+	}
+	if *secret == "" {
+		*secret = sealed.NewSecret()
+	}
+
+	source, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	zipped, _ := metamodel.ToEncodedZip(source, "model.json")
+	if !isModelJson(zipped) {
+		fail(fmt.Errorf("%s is not a valid model.json", flags.Arg(0)))
+	}
+	sealedData, err := sealed.Seal(*secret, zipped)
+	if err != nil {
+		fail(err)
+	}
+	cid := codec.ToOid(codec.Marshal(sealedData)).String()
+	_, err = openStore().Model.Create(cid, sealedData, *title, *description, "", "cli")
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("%s/p/%s/#secret=%s\n", options.Url, cid, *secret)
+}
+
+func renderCommand(args []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		args = append(args[1:], args[0]) // flags may follow the cid
+	}
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	outPath := flags.String("o", "", "output file, .svg renders svg (default png to stdout)")
+	width := flags.Int("width", 0, "width in pixels (default one pixel per model unit)")
+	height := flags.Int("height", 0, "height in pixels")
+	scale := flags.Float64("scale", 0, "multiplies the size, at most 4")
+	background := flags.String("background", "#fff", "hex color or transparent")
+	stateJson := flags.String("state", "", "token vector to draw instead of the initial state")
+	secret := flags.String("secret", "", "share secret of a private model")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		fail(fmt.Errorf("usage: pflow render <cid|model.json> [-o out.png] [-width w] [-height h] [-scale s] [-background #fff] [-state [1,0]] [-secret s]"))
+	}
+
+	zipped := ""
+	if source, err := os.ReadFile(flags.Arg(0)); err == nil {
+		zipped, _ = metamodel.ToEncodedZip(source, "model.json")
+	} else if m := openStore().Model.GetByCid(flags.Arg(0)); m.IpfsCid == flags.Arg(0) {
+		zipped = m.Base64Zipped
+	} else {
+		fail(fmt.Errorf("cid not found: %s", flags.Arg(0)))
+	}
+	if sealed.Is(zipped) {
+		if *secret == "" {
+			fail(fmt.Errorf("%s is private, pass its share secret with -secret", flags.Arg(0)))
+		}
+		opened, err := sealed.Open(*secret, zipped)
+		if err != nil {
+			fail(err)
+		}
+		zipped = opened
+	}
+	if !isModelJson(zipped) {
+		fail(fmt.Errorf("%s is not a valid model", flags.Arg(0)))
+	}
+	mm := metamodel.New()
+	mm.UnpackFromUrl("?z="+zipped, "model.json")
+
+	var state metamodel.Vector
+	if *stateJson != "" {
+		err := codec.Unmarshal([]byte(*stateJson), &state)
+		if err != nil || len(state) != len(mm.Net().Places) {
+			fail(fmt.Errorf("-state must be a json array with one count per place (%d)", len(mm.Net().Places)))
+		}
+	}
+	o := raster.Options{Width: *width, Height: *height, Scale: *scale}
+	if *background != "transparent" && *background != "none" {
+		bg, err := raster.ParseColor(*background)
+		if err != nil {
+			fail(err)
+		}
+		o.Background = bg
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			fail(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	if strings.HasSuffix(*outPath, ".svg") {
+		x1, y1, w, h := mm.GetViewPort()
+		if state == nil {
+			state = mm.Net().InitialVector()
+		}
+		image.NewSvg(out, w, h, x1, y1, w, h).Render(mm, state)
+		return
+	}
+	err := png.Encode(out, raster.Render(mm, state, o))
+	if err != nil {
+		fail(err)
+	}
+}
+
+func sandboxCommand(args []string) {
+	if len(args) == 0 {
+		fail(fmt.Errorf("missing sandbox subcommand\n%s", usage))
+	}
+	flags := flag.NewFlagSet("sandbox "+args[0], flag.ExitOnError)
+	dir := flags.String("dir", "public/sandbox/static", "asset directory, embedded by rice embed-go")
+	_ = flags.Parse(args[1:])
+	switch args[0] {
+	case "pin", "vendor":
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		client := &http.Client{Timeout: time.Minute}
+		var manifest sandbox.Manifest
+		var err error
+		if args[0] == "pin" {
+			manifest, err = sandbox.Pin(ctx, client)
+		} else {
+			manifest, err = sandbox.Vendor(ctx, client, *dir)
+		}
+		if err != nil {
+			fail(err)
+		}
+		for _, name := range manifest.Names() {
+			fmt.Printf("%s\t%s\n", manifest[name], name)
+		}
+	case "verify":
+		manifest, err := sandbox.Verify(http.Dir(*dir))
+		if err != nil {
+			fail(err)
+		}
+		fmt.Fprintf(os.Stderr, "%d assets match their pinned hashes\n", len(manifest))
+	default:
+		fail(fmt.Errorf("unknown sandbox subcommand: %s\n%s", args[0], usage))
+	}
+}
+
+func snippetCommand(args []string) {
+	if len(args) == 0 || args[0] != "run" {
+		fail(fmt.Errorf("unknown snippet subcommand\n%s", usage))
+	}
+	args = args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		args = append(args[1:], args[0]) // flags may follow the cid
+	}
+	flags := flag.NewFlagSet("snippet run", flag.ExitOnError)
+	outPath := flags.String("o", "", "output file (default stdout)")
+	timeout := flags.Duration("timeout", options.SnippetTimeout, "how long the snippet may run")
+	memory := flags.Int64("memory", options.SnippetMemory, "largest string or array in bytes")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		fail(fmt.Errorf("usage: pflow snippet run <cid|declaration.js> [-o model.json] [-timeout 1s] [-memory bytes]"))
+	}
+
+	source := ""
+	if data, err := os.ReadFile(flags.Arg(0)); err == nil {
+		source = string(data)
+	} else if z := openStore().Snippet.GetByCid(flags.Arg(0)); z.IpfsCid == flags.Arg(0) {
+		var ok bool
+		source, ok = metamodel.UnzipUrl("?z="+z.Base64Zipped, "declaration.js")
+		if !ok {
+			fail(fmt.Errorf("%s is not a valid snippet", flags.Arg(0)))
+		}
+	} else {
+		fail(fmt.Errorf("cid not found: %s", flags.Arg(0)))
+	}
+	mm, err := snippet.Eval(context.Background(), source, snippet.Limits{Timeout: *timeout, Memory: uint64(*memory)})
+	if err != nil {
+		fail(err)
+	}
+	data, _ := json.MarshalIndent(mm.ToDeclarationObject(), "", "  ")
+	data = append(data, '\n')
+	if *outPath == "" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(*outPath, data, 0o644)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func tokenCommand(args []string) {
+	if len(args) == 0 {
+		fail(fmt.Errorf("missing token subcommand\n%s", usage))
+	}
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("token create", flag.ExitOnError)
+		name := flags.String("name", "", "label used to list and revoke the token")
+		_ = flags.Parse(args[1:])
+		token, err := openStore().Tokens.Create(*name)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Fprintln(os.Stderr, "store this token now, it cannot be shown again")
+		fmt.Println(token)
+	case "list":
+		tokens, err := openStore().Tokens.List()
+		if err != nil {
+			fail(err)
+		}
+		for _, t := range tokens {
+			fmt.Printf("%d\t%s\t%s\n", t.ID, t.Name, t.CreatedAt.Format(time.RFC3339))
+		}
+	case "revoke":
+		if len(args) != 2 {
+			fail(fmt.Errorf("usage: pflow token revoke <id|name>"))
+		}
+		err := openStore().Tokens.Revoke(args[1])
+		if err != nil {
+			fail(err)
+		}
+	default:
+		fail(fmt.Errorf("unknown token subcommand: %s\n%s", args[0], usage))
+	}
+}
+
+func webhookCommand(args []string) {
+	if len(args) == 0 {
+		fail(fmt.Errorf("missing webhook subcommand\n%s", usage))
+	}
+	switch args[0] {
+	case "add":
+		flags := flag.NewFlagSet("webhook add", flag.ExitOnError)
+		events := flags.String("events", "", "comma separated event types, e.g. modelUnzipped,modelDeleted (default all)")
+		_ = flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			fail(fmt.Errorf("usage: pflow webhook add [-events a,b] url"))
+		}
+		eventTypes := []string{}
+		for _, e := range strings.Split(*events, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				eventTypes = append(eventTypes, e)
+			}
+		}
+		err := app.ValidateWebhook(flags.Arg(0), eventTypes)
+		if err != nil {
+			fail(err)
+		}
+		hook, err := openStore().Webhooks.Create(flags.Arg(0), eventTypes)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Fprintf(os.Stderr, "webhook %d created, deliveries are signed with this secret\n", hook.ID)
+		fmt.Println(hook.Secret)
+	case "list":
+		hooks, err := openStore().Webhooks.List()
+		if err != nil {
+			fail(err)
+		}
+		for _, h := range hooks {
+			events := strings.Join(h.Events, ",")
+			if events == "" {
+				events = "*"
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\n", h.ID, h.Url, events, h.CreatedAt.Format(time.RFC3339))
+		}
+	case "remove":
+		if len(args) != 2 {
+			fail(fmt.Errorf("usage: pflow webhook remove <id>"))
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			fail(fmt.Errorf("invalid webhook id: %s", args[1]))
+		}
+		err = openStore().Webhooks.Remove(id)
+		if err != nil {
+			fail(err)
+		}
+	case "log":
+		flags := flag.NewFlagSet("webhook log", flag.ExitOnError)
+		status := flags.String("status", "", "pending, delivered or dead")
+		webhookId := flags.Int64("webhook", 0, "only deliveries to this webhook")
+		n := flags.Int64("n", 20, "number of deliveries to print")
+		_ = flags.Parse(args[1:])
+		deliveries, err := openStore().Webhooks.Deliveries(storage.DeliveryQuery{WebhookID: *webhookId, Status: *status, Limit: *n})
+		if err != nil {
+			fail(err)
+		}
+		out := json.NewEncoder(os.Stdout)
+		for _, d := range deliveries {
+			_ = out.Encode(d)
+		}
+	case "retry":
+		if len(args) != 2 {
+			fail(fmt.Errorf("usage: pflow webhook retry <delivery id>"))
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			fail(fmt.Errorf("invalid delivery id: %s", args[1]))
+		}
+		found, err := openStore().Webhooks.Retry(id)
+		if err != nil {
+			fail(err)
+		}
+		if !found {
+			fail(fmt.Errorf("no dead delivery with id %s", args[1]))
+		}
+	default:
+		fail(fmt.Errorf("unknown webhook subcommand: %s\n%s", args[0], usage))
+	}
+}
+
+func isModelJson(zipped string) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	_, ok = metamodel.New().UnpackFromUrl("?z="+zipped, "model.json")
+	return ok
+}
@@ -4,15 +4,20 @@ go 1.21.0
 
 require (
 	github.com/GeertJohan/go.rice v1.0.3
+	github.com/dop251/goja v0.0.0-20241024094426-79f3a7efcdbd
 	github.com/gorilla/mux v1.8.1
+	github.com/ipfs/go-cid v0.4.1
 	github.com/mattn/go-sqlite3 v1.14.20
 	github.com/pflow-dev/go-metamodel/v2 v2.1.3
+	golang.org/x/crypto v0.18.0
 )
 
 require (
 	github.com/daaku/go.zipexe v1.0.2 // indirect
+	github.com/dlclark/regexp2 v1.11.4 // indirect
 	github.com/gibson042/canonicaljson-go v1.0.3 // indirect
-	github.com/ipfs/go-cid v0.4.1 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.6 // indirect
 	github.com/minio/sha256-simd v1.0.1 // indirect
 	github.com/mr-tron/base58 v1.2.0 // indirect
@@ -22,7 +27,7 @@ require (
 	github.com/multiformats/go-multihash v0.2.3 // indirect
 	github.com/multiformats/go-varint v0.0.7 // indirect
 	github.com/spaolacci/murmur3 v1.1.0 // indirect
-	golang.org/x/crypto v0.18.0 // indirect
 	golang.org/x/sys v0.16.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 	lukechampine.com/blake3 v1.2.1 // indirect
 )
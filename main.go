@@ -1,28 +1,60 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	rice "github.com/GeertJohan/go.rice"
-	"github.com/pflow-dev/go-metamodel/v2/server"
+	"github.com/pflow-dev/go-metamodel/v2/model"
 	"github.com/pflow-dev/pflow-cli/app"
 	"github.com/pflow-dev/pflow-cli/internal/examples"
 	"github.com/pflow-dev/pflow-cli/storage"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var (
 	options = app.Options{
-		Host:         "127.0.0.1",
-		Port:         "8083",
-		Url:          "http://localhost:8083",
-		DbPath:       "/tmp/pflow.db",
-		LoadExamples: true,
-		UseSandbox:   false, // sandbox relies on js from CDN
+		Host:             "127.0.0.1",
+		Port:             "8083",
+		Url:              "http://localhost:8083",
+		DbPath:           "/tmp/pflow.db",
+		LoadExamples:     true,
+		UseSandbox:       false, // needs the assets from pflow sandbox vendor, see build.sh
+		CacheEntries:     1024,
+		CacheBytes:       64 << 20,
+		ReadTimeout:      15 * time.Second,
+		WriteTimeout:     30 * time.Second,
+		IdleTimeout:      2 * time.Minute,
+		ShutdownTimeout:  30 * time.Second,
+		IngestRate:       1,
+		IngestBurst:      30,
+		MaxZippedBytes:   256 << 10,
+		MaxUnzippedBytes: 4 << 20,
+		WebhookAttempts:  8,
+		WebhookBackoff:   10 * time.Second,
+		WebhookTimeout:   10 * time.Second,
+		MaxSessions:      100,
+		SessionIdle:      30 * time.Minute,
+		SnippetTimeout:   time.Second,
+		SnippetMemory:    64 << 20,
 	}
 )
 
 func main() {
+	loadEnv()
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+	serve()
+}
+
+func loadEnv() {
 	dbPath, pathSet := os.LookupEnv("DB_PATH")
 	if pathSet {
 		options.DbPath = dbPath
@@ -43,24 +75,223 @@ func main() {
 	if sandboxSet {
 		options.UseSandbox = true
 	}
+	cacheEntries, entriesSet := os.LookupEnv("CACHE_ENTRIES")
+	if entriesSet {
+		options.CacheEntries = int(envInt("CACHE_ENTRIES", cacheEntries))
+	}
+	cacheBytes, bytesSet := os.LookupEnv("CACHE_BYTES")
+	if bytesSet {
+		options.CacheBytes = envInt("CACHE_BYTES", cacheBytes)
+	}
+	ingestRate, rateSet := os.LookupEnv("INGEST_RATE")
+	if rateSet {
+		rate, err := strconv.ParseFloat(ingestRate, 64)
+		if err != nil {
+			panic(fmt.Sprintf("invalid INGEST_RATE: %v", err))
+		}
+		options.IngestRate = rate
+	}
+	ingestBurst, burstSet := os.LookupEnv("INGEST_BURST")
+	if burstSet {
+		options.IngestBurst = int(envInt("INGEST_BURST", ingestBurst))
+	}
+	maxZipped, zippedSet := os.LookupEnv("MAX_ZIPPED_BYTES")
+	if zippedSet {
+		options.MaxZippedBytes = int(envInt("MAX_ZIPPED_BYTES", maxZipped))
+	}
+	maxUnzipped, unzippedSet := os.LookupEnv("MAX_UNZIPPED_BYTES")
+	if unzippedSet {
+		options.MaxUnzippedBytes = envInt("MAX_UNZIPPED_BYTES", maxUnzipped)
+	}
+	_, metricsSet := os.LookupEnv("METRICS")
+	if metricsSet {
+		options.Metrics = true
+	}
+	metricsAddr, metricsAddrSet := os.LookupEnv("METRICS_ADDR")
+	if metricsAddrSet {
+		options.MetricsAddr = metricsAddr
+	}
+	logFormat, formatSet := os.LookupEnv("LOG_FORMAT")
+	if formatSet {
+		if logFormat != app.LogFormatText && logFormat != app.LogFormatJson {
+			panic(fmt.Sprintf("invalid LOG_FORMAT: %s, expected text or json", logFormat))
+		}
+		options.LogFormat = logFormat
+	}
+	logLevel, levelSet := os.LookupEnv("LOG_LEVEL")
+	if levelSet {
+		err := options.LogLevel.UnmarshalText([]byte(logLevel))
+		if err != nil {
+			panic(fmt.Sprintf("invalid LOG_LEVEL: %v", err))
+		}
+	}
+	_, readOnlySet := os.LookupEnv("READ_ONLY")
+	if readOnlySet {
+		options.ReadOnly = true
+	}
+	_, requireTokenSet := os.LookupEnv("REQUIRE_TOKEN")
+	if requireTokenSet {
+		options.RequireToken = true
+	}
+	_, trustProxySet := os.LookupEnv("TRUST_PROXY")
+	if trustProxySet {
+		options.TrustProxy = true
+	}
+	proxyHops, hopsSet := os.LookupEnv("PROXY_HOPS")
+	if hopsSet {
+		options.ProxyHops = int(envInt("PROXY_HOPS", proxyHops))
+	}
+	tlsCert, certSet := os.LookupEnv("TLS_CERT")
+	if certSet {
+		options.TLSCert = tlsCert
+	}
+	tlsKey, keySet := os.LookupEnv("TLS_KEY")
+	if keySet {
+		options.TLSKey = tlsKey
+	}
+	_, selfSignedSet := os.LookupEnv("TLS_SELF_SIGNED")
+	if selfSignedSet {
+		options.TLSSelfSigned = true
+	}
+	redirectPort, redirectSet := os.LookupEnv("TLS_REDIRECT_PORT")
+	if redirectSet {
+		options.RedirectPort = redirectPort
+	}
+	if !urlSet && (certSet || selfSignedSet) {
+		options.Url = strings.Replace(options.Url, "http://", "https://", 1)
+	}
+	webhookAttempts, attemptsSet := os.LookupEnv("WEBHOOK_ATTEMPTS")
+	if attemptsSet {
+		options.WebhookAttempts = int(envInt("WEBHOOK_ATTEMPTS", webhookAttempts))
+	}
+	editorDir, editorDirSet := os.LookupEnv("EDITOR_DIR")
+	if editorDirSet {
+		options.EditorDir = editorDir
+	}
+	snippetMemory, snippetMemorySet := os.LookupEnv("SNIPPET_MEMORY")
+	if snippetMemorySet {
+		options.SnippetMemory = envInt("SNIPPET_MEMORY", snippetMemory)
+	}
+	maxSessions, sessionsSet := os.LookupEnv("MAX_SESSIONS")
+	if sessionsSet {
+		options.MaxSessions = int(envInt("MAX_SESSIONS", maxSessions))
+	}
+	for name, d := range map[string]*time.Duration{
+		"READ_TIMEOUT":     &options.ReadTimeout,
+		"WRITE_TIMEOUT":    &options.WriteTimeout,
+		"IDLE_TIMEOUT":     &options.IdleTimeout,
+		"SHUTDOWN_TIMEOUT": &options.ShutdownTimeout,
+		"WEBHOOK_BACKOFF":  &options.WebhookBackoff,
+		"WEBHOOK_TIMEOUT":  &options.WebhookTimeout,
+		"SESSION_IDLE":     &options.SessionIdle,
+		"SNIPPET_TIMEOUT":  &options.SnippetTimeout,
+	} {
+		value, set := os.LookupEnv(name)
+		if set {
+			*d = envDuration(name, value)
+		}
+	}
+}
+
+func envInt(name string, value string) int64 {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		panic(fmt.Sprintf("invalid %s: %v", name, err))
+	}
+	return n
+}
+
+func envDuration(name string, value string) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Sprintf("invalid %s: %v", name, err))
+	}
+	return d
+}
+
+// reloadOnHangup re-reads tls certificates on SIGHUP, e.g. after a renewal
+func reloadOnHangup(s *app.Server) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		err := s.ReloadCertificates()
+		if err != nil {
+			s.Logger.Error("failed to reload certificates", "err", err)
+			continue
+		}
+		s.Logger.Info("reloaded certificates")
+	}
+}
+
+func serve() {
 	store := storage.New(storage.ResetDb(options.DbPath))
 
-	s := app.New(server.Storage{
-		Model:   store.Model,
-		Snippet: store.Snippet,
-	}, options)
+	s := app.New(store, options)
 
-	if options.LoadExamples {
+	if options.LoadExamples && !options.ReadOnly {
+		batch := []*model.Zblob{}
+		for _, m := range examples.ExampleModels {
+			example := *m.Zblob
+			example.Referer = strings.TrimRight(options.Url, "/") + "/p/"
+			batch = append(batch, &example)
+		}
+		err := store.Model.CreateBatch(batch)
+		if err != nil {
+			panic(err)
+		}
 		for _, m := range examples.ExampleModels {
-			_, _ = store.Model.Create(m.IpfsCid, m.Base64Zipped, m.Title, m.Description, m.Keywords, "http://localhost:8083/p/")
 			foundModel := store.Model.GetByCid(m.IpfsCid)
 			if foundModel.IpfsCid != m.IpfsCid {
 				panic(fmt.Sprintf("Failed to load model %s %s", m.Title, m.IpfsCid))
 			}
-			s.PrintLinks(foundModel.ToModel(), options.Url)
+			s.PrintLinks(foundModel.ToModel(), strings.TrimRight(options.Url, "/"))
 		}
-		s.Logger.Print("Loaded example models")
+		s.Logger.Info("loaded example models")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopped := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		stop() // a second signal kills the process
+		s.Logger.Info("shutting down", "timeout", options.ShutdownTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), options.ShutdownTimeout)
+		defer cancel()
+		stopped <- s.Shutdown(shutdownCtx)
+	}()
+	if options.TLSCert != "" || options.TLSSelfSigned {
+		go reloadOnHangup(s) // otherwise SIGHUP keeps its default and stops the server
+	}
+
+	var editor http.FileSystem
+	if options.EditorDir != "" {
+		s.Logger.Info("serving the editor from disk", "dir", options.EditorDir)
+		editor = app.EditorDir(options.EditorDir)
+	} else {
+		editor = rice.MustFindBox("./public").HTTPBox()
+	}
+	err := s.LoadEditorAssets(editor)
+	if err != nil {
+		panic(err)
+	}
+	if options.UseSandbox {
+		var assets http.FileSystem
+		if sandboxBox, err := rice.FindBox("./public/sandbox/static"); err == nil {
+			assets = sandboxBox.HTTPBox()
+		}
+		err = s.LoadSandboxAssets(assets)
+		if err != nil {
+			panic(err)
+		}
+	}
+	err = s.ListenAndServe()
+	if err != nil {
+		panic(err)
+	}
+	err = <-stopped
+	if err != nil {
+		s.Logger.Error("shutdown failed", "err", err)
+		os.Exit(1)
 	}
-	box := rice.MustFindBox("./public")
-	s.ServeHTTP(http.FileServer(box.HTTPBox()))
+	s.Logger.Info("stopped")
 }
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("requests_total", "Requests served.", "route", "status")
+	latency := r.Histogram("latency_seconds", "Request latency.", []float64{0.1, 1}, "route")
+	r.GaugeFunc("entries", "Cached entries.", func(emit Emit) {
+		emit(3, "models")
+	}, "cache")
+
+	requests.Inc("/p/", "200")
+	requests.Inc("/p/", "200")
+	requests.Inc(`/a"b`, "404")
+	latency.Observe(0.05, "/p/")
+	latency.Observe(0.5, "/p/")
+	latency.Observe(5, "/p/")
+
+	out := new(strings.Builder)
+	if err := r.WriteText(out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP entries Cached entries.
+# TYPE entries gauge
+entries{cache="models"} 3
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/p/",le="0.1"} 1
+latency_seconds_bucket{route="/p/",le="1"} 2
+latency_seconds_bucket{route="/p/",le="+Inf"} 3
+latency_seconds_sum{route="/p/"} 5.55
+latency_seconds_count{route="/p/"} 3
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="/a\"b",status="404"} 1
+requests_total{route="/p/",status="200"} 2
+`
+	if out.String() != expected {
+		t.Fatalf("unexpected exposition:\n%s", out.String())
+	}
+}
@@ -0,0 +1,168 @@
+package raster
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// canvas draws anti-aliased shapes from their signed distance functions,
+// coordinates are model units and converted to pixels with scale
+type canvas struct {
+	img    *image.RGBA
+	scale  float64
+	dx, dy float64 // centers the viewport when the aspect ratio differs
+	x1, y1 float64 // top left of the viewport in model units
+}
+
+// sdf is the distance in pixels from a pixel center to the edge of a shape, negative inside
+type sdf func(px, py float64) float64
+
+func (c *canvas) px(x, y float64) (float64, float64) {
+	return (x-c.x1)*c.scale + c.dx, (y-c.y1)*c.scale + c.dy
+}
+
+func (c *canvas) clear(bg color.Color) {
+	r, g, b, a := bg.RGBA()
+	fill := color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: uint8(a >> 8)}
+	pix := c.img.Pix
+	for i := 0; i < len(pix); i += 4 {
+		pix[i], pix[i+1], pix[i+2], pix[i+3] = fill.R, fill.G, fill.B, fill.A
+	}
+}
+
+// fill blends col into every pixel of the bounding box by how much of it the shape covers
+func (c *canvas) fill(minX, minY, maxX, maxY float64, col color.RGBA, dist sdf) {
+	b := c.img.Bounds()
+	x0, y0 := max(int(math.Floor(minX))-1, b.Min.X), max(int(math.Floor(minY))-1, b.Min.Y)
+	x1, y1 := min(int(math.Ceil(maxX))+1, b.Max.X), min(int(math.Ceil(maxY))+1, b.Max.Y)
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			coverage := math.Max(0, math.Min(1, 0.5-dist(float64(x)+0.5, float64(y)+0.5)))
+			if coverage > 0 {
+				c.blend(x, y, col, coverage)
+			}
+		}
+	}
+}
+
+// blend composites a straight alpha color over a premultiplied pixel
+func (c *canvas) blend(x, y int, col color.RGBA, coverage float64) {
+	i := c.img.PixOffset(x, y)
+	p := c.img.Pix[i : i+4 : i+4]
+	a := float64(col.A) / 255 * coverage
+	p[0] = uint8(float64(col.R)*a + float64(p[0])*(1-a) + 0.5)
+	p[1] = uint8(float64(col.G)*a + float64(p[1])*(1-a) + 0.5)
+	p[2] = uint8(float64(col.B)*a + float64(p[2])*(1-a) + 0.5)
+	p[3] = uint8(255*a + float64(p[3])*(1-a) + 0.5)
+}
+
+func (c *canvas) disc(x, y, r float64, col color.RGBA) {
+	cx, cy := c.px(x, y)
+	r *= c.scale
+	c.fill(cx-r, cy-r, cx+r, cy+r, col, func(px, py float64) float64 {
+		return math.Hypot(px-cx, py-cy) - r
+	})
+}
+
+func (c *canvas) ring(x, y, r, width float64, col color.RGBA) {
+	cx, cy := c.px(x, y)
+	r, half := r*c.scale, math.Max(width*c.scale, 1)/2
+	c.fill(cx-r-half, cy-r-half, cx+r+half, cy+r+half, col, func(px, py float64) float64 {
+		return math.Abs(math.Hypot(px-cx, py-cy)-r) - half
+	})
+}
+
+func (c *canvas) line(x1, y1, x2, y2, width float64, col color.RGBA) {
+	ax, ay := c.px(x1, y1)
+	bx, by := c.px(x2, y2)
+	half := math.Max(width*c.scale, 1) / 2
+	dx, dy := bx-ax, by-ay
+	length2 := dx*dx + dy*dy
+	c.fill(math.Min(ax, bx)-half, math.Min(ay, by)-half, math.Max(ax, bx)+half, math.Max(ay, by)+half, col, func(px, py float64) float64 {
+		t := 0.0
+		if length2 > 0 {
+			t = math.Max(0, math.Min(1, ((px-ax)*dx+(py-ay)*dy)/length2))
+		}
+		return math.Hypot(px-(ax+t*dx), py-(ay+t*dy)) - half
+	})
+}
+
+// roundedBox is the distance to a rectangle with corner radius r
+func roundedBox(x, y, w, h, r float64) sdf {
+	cx, cy, hw, hh := x+w/2, y+h/2, w/2-r, h/2-r
+	return func(px, py float64) float64 {
+		qx, qy := math.Abs(px-cx)-hw, math.Abs(py-cy)-hh
+		return math.Hypot(math.Max(qx, 0), math.Max(qy, 0)) + math.Min(math.Max(qx, qy), 0) - r
+	}
+}
+
+func (c *canvas) rect(x, y, w, h, r float64, col color.RGBA) {
+	px, py := c.px(x, y)
+	w, h, r = w*c.scale, h*c.scale, r*c.scale
+	c.fill(px, py, px+w, py+h, col, roundedBox(px, py, w, h, r))
+}
+
+func (c *canvas) rectStroke(x, y, w, h, r, width float64, col color.RGBA) {
+	px, py := c.px(x, y)
+	w, h, r = w*c.scale, h*c.scale, r*c.scale
+	half := math.Max(width*c.scale, 1) / 2
+	box := roundedBox(px, py, w, h, r)
+	c.fill(px-half, py-half, px+w+half, py+h+half, col, func(x, y float64) float64 {
+		return math.Abs(box(x, y)) - half
+	})
+}
+
+// triangle fills a convex triangle given in either winding order
+func (c *canvas) triangle(x1, y1, x2, y2, x3, y3 float64, col color.RGBA) {
+	var xs, ys [3]float64
+	xs[0], ys[0] = c.px(x1, y1)
+	xs[1], ys[1] = c.px(x2, y2)
+	xs[2], ys[2] = c.px(x3, y3)
+	winding := 1.0
+	if (xs[1]-xs[0])*(ys[2]-ys[0])-(ys[1]-ys[0])*(xs[2]-xs[0]) < 0 {
+		winding = -1
+	}
+	c.fill(min(xs[0], xs[1], xs[2]), min(ys[0], ys[1], ys[2]), max(xs[0], xs[1], xs[2]), max(ys[0], ys[1], ys[2]), col, func(px, py float64) float64 {
+		d := math.Inf(-1)
+		for i := 0; i < 3; i++ {
+			j := (i + 1) % 3
+			ex, ey := xs[j]-xs[i], ys[j]-ys[i]
+			// outward distance from the edge, the largest one is the distance to the triangle
+			d = math.Max(d, winding*((px-xs[i])*ey-(py-ys[i])*ex)/math.Hypot(ex, ey))
+		}
+		return d
+	})
+}
+
+// text draws s with its baseline at y like svg text, size is the font size in model units
+func (c *canvas) text(x, y float64, s string, size float64, col color.RGBA) {
+	dot := size / 10 * c.scale // the 5x7 glyphs fill about 70% of the font size
+	left, baseline := c.px(x, y)
+	top := baseline - glyphHeight*dot
+	for _, r := range s {
+		glyph, ok := font[r]
+		if !ok {
+			glyph = font['?']
+		}
+		// one shape per glyph so neighbouring dots do not leave seams
+		var dots []sdf
+		for column, bits := range glyph {
+			for row := 0; row < glyphHeight; row++ {
+				if bits&(1<<row) != 0 {
+					dots = append(dots, roundedBox(left+float64(column)*dot, top+float64(row)*dot, dot, dot, 0))
+				}
+			}
+		}
+		if len(dots) > 0 {
+			c.fill(left, top, left+glyphWidth*dot, baseline, col, func(px, py float64) float64 {
+				d := math.Inf(1)
+				for _, box := range dots {
+					d = math.Min(d, box(px, py))
+				}
+				return d
+			})
+		}
+		left += glyphAdvance * dot
+	}
+}
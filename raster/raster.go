@@ -0,0 +1,245 @@
+package raster
+
+import (
+	"errors"
+	"github.com/pflow-dev/go-metamodel/v2/metamodel"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the geometry follows go-metamodel's svg renderer so both images of a model look alike
+
+const (
+	MaxSide   = 2048 // largest width or height in pixels, larger requests are scaled down
+	MaxScale  = 4
+	placeR    = 16
+	tokenR    = 2
+	transSize = 30
+	smallText = 13
+	largeText = 18
+	arrowTip  = 21 // distance of the arrow tip from the target center
+	arrowBase = 29
+	inhibitAt = 26 // center of the inhibitor circle from the target center
+	inhibitR  = 4
+)
+
+var (
+	black     = color.RGBA{A: 0xff}
+	white     = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	enabled   = color.RGBA{R: 0x62, G: 0xfa, B: 0x75, A: 0xff}
+	inhibited = color.RGBA{R: 0xfa, G: 0xb5, B: 0xb0, A: 0xff}
+
+	ErrBadColor = errors.New("raster: expected a color like #fff, #ffffff, #ffffff80 or transparent")
+)
+
+// Options size the image, without Width or Height one model unit is one pixel,
+// Scale multiplies the result for high density screens
+type Options struct {
+	Width      int
+	Height     int
+	Scale      float64
+	Background color.Color // nil leaves the image transparent
+}
+
+// ParseColor reads hex colors with or without the leading #
+func ParseColor(s string) (color.Color, error) {
+	if s == "transparent" || s == "none" {
+		return color.Transparent, nil
+	}
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 || len(hex) == 4 {
+		long := make([]byte, 0, 8)
+		for i := range hex {
+			long = append(long, hex[i], hex[i])
+		}
+		hex = string(long)
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return nil, ErrBadColor
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, ErrBadColor
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+// Size returns the image dimensions and pixels per model unit for a viewport of w x h
+func (o Options) Size(w, h int) (width int, height int, scale float64) {
+	w, h = max(w, 1), max(h, 1)
+	switch {
+	case o.Width > 0 && o.Height > 0:
+		scale = min(float64(o.Width)/float64(w), float64(o.Height)/float64(h))
+		width, height = o.Width, o.Height
+	case o.Width > 0:
+		scale = float64(o.Width) / float64(w)
+		width, height = o.Width, int(math.Round(float64(h)*scale))
+	case o.Height > 0:
+		scale = float64(o.Height) / float64(h)
+		width, height = int(math.Round(float64(w)*scale)), o.Height
+	default:
+		scale, width, height = 1, w, h
+	}
+	if o.Scale > 0 {
+		factor := min(o.Scale, MaxScale)
+		scale *= factor
+		width, height = int(math.Round(float64(width)*factor)), int(math.Round(float64(height)*factor))
+	}
+	if side := max(width, height); side > MaxSide {
+		shrink := float64(MaxSide) / float64(side)
+		scale *= shrink
+		width, height = int(float64(width)*shrink), int(float64(height)*shrink)
+	}
+	return max(width, 1), max(height, 1), scale
+}
+
+// Render draws mm in the given state, an empty state draws the initial marking
+func Render(mm metamodel.MetaModel, state metamodel.Vector, o Options) *image.RGBA {
+	net := mm.Net()
+	if len(state) != len(net.Places) {
+		state = net.InitialVector()
+	}
+	x1, y1, w, h := mm.GetViewPort()
+	width, height, scale := o.Size(w, h)
+	c := &canvas{
+		img:   image.NewRGBA(image.Rect(0, 0, width, height)),
+		scale: scale,
+		dx:    (float64(width) - float64(w)*scale) / 2,
+		dy:    (float64(height) - float64(h)*scale) / 2,
+		x1:    float64(x1),
+		y1:    float64(y1),
+	}
+	if o.Background != nil {
+		c.clear(o.Background)
+	}
+
+	process := mm.Execute(state)
+	for _, a := range net.Arcs {
+		c.arc(a)
+	}
+	for _, label := range sortedKeys(net.Places) {
+		c.place(net.Places[label], process.TokenCount(label))
+	}
+	for _, label := range sortedKeys(net.Transitions) {
+		t := net.Transitions[label]
+		op := metamodel.Op{Action: t.Label, Multiple: 1, Role: t.Role.Label}
+		fill := white
+		valid, _, _ := process.TestFire(op)
+		blocked, _ := process.Inhibited(op)
+		if valid {
+			fill = enabled
+		} else if blocked {
+			fill = inhibited
+		}
+		c.transition(t, fill)
+	}
+	return c.img
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// arcWeight is the token count printed on an arc, 0 when the model is missing a guard
+func arcWeight(a metamodel.Arc) int64 {
+	var p *metamodel.Place
+	var t *metamodel.Transition
+	if a.Source.IsPlace() {
+		p, t = a.Source.GetPlace(), a.Target.GetTransition()
+	} else {
+		t, p = a.Source.GetTransition(), a.Target.GetPlace()
+	}
+	if p == nil || t == nil {
+		return 0
+	}
+	delta := t.Delta
+	if a.Inhibitor {
+		g, ok := t.Guards[p.Label]
+		if !ok {
+			return 0
+		}
+		delta = g.Delta
+	}
+	if p.Offset >= int64(len(delta)) {
+		return 0
+	}
+	if delta[p.Offset] < 0 {
+		return -delta[p.Offset]
+	}
+	return delta[p.Offset]
+}
+
+func position(n metamodel.Node) (float64, float64) {
+	if n.IsPlace() {
+		p := n.GetPlace()
+		return float64(p.X), float64(p.Y)
+	}
+	t := n.GetTransition()
+	return float64(t.X), float64(t.Y)
+}
+
+func (c *canvas) arc(a metamodel.Arc) {
+	x1, y1 := position(a.Source)
+	x2, y2 := position(a.Target)
+	length := math.Hypot(x2-x1, y2-y1)
+	if length > arrowBase {
+		ux, uy := (x2-x1)/length, (y2-y1)/length
+		at := func(d float64) (float64, float64) { return x2 - ux*d, y2 - uy*d }
+		if a.Inhibitor {
+			ex, ey := at(inhibitAt + inhibitR)
+			c.line(x1, y1, ex, ey, 1, black)
+			cx, cy := at(inhibitAt)
+			c.disc(cx, cy, inhibitR, black)
+		} else {
+			ex, ey := at(arrowBase)
+			c.line(x1, y1, ex, ey, 1, black)
+			tx, ty := at(arrowTip)
+			half := 4.5
+			c.triangle(tx, ty, ex-uy*half, ey+ux*half, ex+uy*half, ey-ux*half, black)
+		}
+	}
+
+	midX, midY := math.Trunc((x1+x2)/2), math.Trunc((y1+y2)/2)-8
+	offsetX, offsetY := 4.0, 4.0
+	if math.Abs(x2-midX) < 8 {
+		offsetX = 8
+	}
+	if math.Abs(x2-midY) < 8 { // matches the svg renderer
+		offsetY = 0
+	}
+	c.text(midX-offsetX, midY+offsetY, strconv.FormatInt(arcWeight(a), 10), smallText, black)
+}
+
+func (c *canvas) place(p *metamodel.Place, tokens int64) {
+	x, y := float64(p.X), float64(p.Y)
+	c.disc(x, y, placeR, white)
+	c.ring(x, y, placeR, 1.5, black)
+	c.text(x-18, y-20, p.Label, smallText, black)
+	switch {
+	case tokens == 1:
+		c.disc(x, y, tokenR, black)
+	case tokens > 1 && tokens < 10:
+		c.text(x-4, y+5, strconv.FormatInt(tokens, 10), largeText, black)
+	case tokens >= 10:
+		c.text(x-7, y+5, strconv.FormatInt(tokens, 10), smallText, black)
+	}
+}
+
+func (c *canvas) transition(t *metamodel.Transition, fill color.RGBA) {
+	x, y := float64(t.X-17), float64(t.Y-17)
+	c.rect(x, y, transSize, transSize, 4, fill)
+	c.rectStroke(x, y, transSize, transSize, 4, 1, black)
+	c.text(x, y-8, t.Label, smallText, black)
+}
@@ -0,0 +1,97 @@
+package raster
+
+import (
+	"github.com/pflow-dev/go-metamodel/v2/metamodel"
+	. "github.com/pflow-dev/pflow-cli/internal/examples"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func inhibitorTest(t *testing.T) metamodel.MetaModel {
+	mm := metamodel.New()
+	if _, ok := mm.UnpackFromUrl("?z="+InhibitorTest.Base64Zipped, "model.json"); !ok {
+		t.Fatal("failed to unpack model")
+	}
+	return mm
+}
+
+// at reads the pixel drawn for a point in model units when rendered at one pixel per unit
+func at(img *image.RGBA, mm metamodel.MetaModel, x, y int) color.RGBA {
+	x1, y1, _, _ := mm.GetViewPort()
+	return img.RGBAAt(x-x1, y-y1)
+}
+
+func TestRender(t *testing.T) {
+	mm := inhibitorTest(t)
+	img := Render(mm, nil, Options{Background: white})
+	if b := img.Bounds(); b.Dx() != 220 || b.Dy() != 220 {
+		t.Fatalf("expected the 220x220 viewport, got %v", b)
+	}
+	if c := img.RGBAAt(0, 0); c != white {
+		t.Fatalf("expected background, got %v", c)
+	}
+	// inc is enabled and bar inhibited in the initial state, foo holds one token
+	if c := at(img, mm, 200, 200); c != enabled {
+		t.Fatalf("expected enabled transition, got %v", c)
+	}
+	if c := at(img, mm, 200, 300); c != inhibited {
+		t.Fatalf("expected inhibited transition, got %v", c)
+	}
+	if c := at(img, mm, 250, 250); c != black {
+		t.Fatalf("expected a token, got %v", c)
+	}
+
+	empty := Render(mm, metamodel.Vector{0}, Options{Background: white})
+	if c := at(empty, mm, 250, 250); c != white {
+		t.Fatalf("expected an empty place, got %v", c)
+	}
+	if c := at(empty, mm, 300, 200); c == enabled {
+		t.Fatal("dec cannot fire without tokens")
+	}
+
+	if c := Render(mm, nil, Options{}).RGBAAt(0, 0); c.A != 0 {
+		t.Fatalf("expected a transparent background, got %v", c)
+	}
+}
+
+func TestSize(t *testing.T) {
+	for _, tc := range []struct {
+		o             Options
+		width, height int
+		scale         float64
+	}{
+		{Options{}, 200, 100, 1},
+		{Options{Scale: 2}, 400, 200, 2},
+		{Options{Width: 100}, 100, 50, 0.5},
+		{Options{Height: 300}, 600, 300, 3},
+		{Options{Width: 100, Height: 100}, 100, 100, 0.5},
+		{Options{Width: 100, Scale: 2}, 200, 100, 1},
+		{Options{Width: 10000}, MaxSide, MaxSide / 2, float64(MaxSide) / 200},
+		{Options{Scale: 100}, 800, 400, MaxScale},
+	} {
+		width, height, scale := tc.o.Size(200, 100)
+		if width != tc.width || height != tc.height || scale != tc.scale {
+			t.Fatalf("%+v: expected %dx%d at %v, got %dx%d at %v", tc.o, tc.width, tc.height, tc.scale, width, height, scale)
+		}
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	for in, want := range map[string]color.Color{
+		"#fff":        color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		"1e1e1e":      color.NRGBA{R: 0x1e, G: 0x1e, B: 0x1e, A: 0xff},
+		"#00000080":   color.NRGBA{A: 0x80},
+		"transparent": color.Transparent,
+	} {
+		got, err := ParseColor(in)
+		if err != nil || got != want {
+			t.Fatalf("%s: expected %v got %v %v", in, want, got, err)
+		}
+	}
+	for _, in := range []string{"", "#ff", "red", "#gggggg"} {
+		if _, err := ParseColor(in); err == nil {
+			t.Fatalf("%s: expected an error", in)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d should fit in the burst", i)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms, got %v %v", ok, wait)
+	}
+	if ok, _ = l.Allow("b"); !ok {
+		t.Fatal("clients must not share a bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ = l.Allow("a"); !ok {
+		t.Fatal("expected a token after refill")
+	}
+
+	now = now.Add(time.Hour)
+	_, _ = l.Allow("c")
+	if l.Len() != 1 {
+		t.Fatalf("expected idle buckets to be swept, have %d", l.Len())
+	}
+}
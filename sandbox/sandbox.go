@@ -0,0 +1,155 @@
+package sandbox
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// the sandbox page loads these third party files from /sandbox/static/ instead of a CDN,
+// they are downloaded at build time with Vendor and embedded in the binary, like the rest of public/
+// they are not committed, the pinned hashes below make the download as reviewable as a committed copy
+
+// Asset is a file the sandbox page loads, pinned to an exact release and its sha384 hash
+type Asset struct {
+	Name      string // path under /sandbox/static/
+	Url       string
+	Integrity string // compare with the publisher's SRI hash before changing, see pflow sandbox pin
+}
+
+const maxAssetSize = 16 << 20
+
+// Assets are unpinned until a maintainer fills in Integrity from pflow sandbox pin,
+// Vendor and Verify refuse an asset without a hash rather than trusting whatever the CDN serves
+var Assets = []Asset{
+	{"jquery.min.js", "https://cdn.jsdelivr.net/npm/jquery@3.7.1/dist/jquery.min.js", ""},
+	{"jquery.terminal.min.js", "https://cdn.jsdelivr.net/npm/jquery.terminal@2.37.2/js/jquery.terminal.min.js", ""},
+	{"jquery.terminal.min.css", "https://cdn.jsdelivr.net/npm/jquery.terminal@2.37.2/css/jquery.terminal.min.css", ""},
+	// ace loads modes and workers from its base path when the editor starts
+	{"ace/ace.js", "https://cdn.jsdelivr.net/npm/ace-builds@1.16.0/src-min-noconflict/ace.js", ""},
+	{"ace/mode-javascript.js", "https://cdn.jsdelivr.net/npm/ace-builds@1.16.0/src-min-noconflict/mode-javascript.js", ""},
+	{"ace/worker-javascript.js", "https://cdn.jsdelivr.net/npm/ace-builds@1.16.0/src-min-noconflict/worker-javascript.js", ""},
+	{"jszip.min.js", "https://cdn.jsdelivr.net/npm/jszip@3.10.1/dist/jszip.min.js", ""},
+	{"pflow.css", "https://cdn.jsdelivr.net/gh/pflow-dev/pflow-js@v1.0.2/styles/pflow.css", ""},
+	{"pflow.js", "https://cdn.jsdelivr.net/gh/pflow-dev/pflow-js@v1.0.2/src/pflow.js", ""},
+}
+
+// Manifest maps asset names to subresource integrity hashes
+type Manifest map[string]string
+
+// Integrity is the sha384 hash in the format of the html integrity attribute
+func Integrity(data []byte) string {
+	sum := sha512.Sum384(data)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// check compares data with the pinned hash of a
+func (a Asset) check(data []byte) error {
+	if a.Integrity == "" {
+		return fmt.Errorf("sandbox: %s has no pinned integrity hash in sandbox/sandbox.go, see pflow sandbox pin", a.Name)
+	}
+	if got := Integrity(data); got != a.Integrity {
+		return fmt.Errorf("sandbox: %s does not match its integrity hash, expected %s got %s", a.Name, a.Integrity, got)
+	}
+	return nil
+}
+
+// Pin downloads every asset and returns the hashes it was served with, for review before
+// they are copied into Assets, it writes nothing
+func Pin(ctx context.Context, client *http.Client) (Manifest, error) {
+	manifest := Manifest{}
+	for _, a := range Assets {
+		data, err := download(ctx, client, a.Url)
+		if err != nil {
+			return nil, fmt.Errorf("sandbox: %s: %w", a.Name, err)
+		}
+		manifest[a.Name] = Integrity(data)
+	}
+	return manifest, nil
+}
+
+// Vendor downloads every asset into dir, nothing is written unless all of them match their pinned hash
+func Vendor(ctx context.Context, client *http.Client, dir string) (Manifest, error) {
+	files := map[string][]byte{}
+	for _, a := range Assets {
+		data, err := download(ctx, client, a.Url)
+		if err != nil {
+			return nil, fmt.Errorf("sandbox: %s: %w", a.Name, err)
+		}
+		if err = a.check(data); err != nil {
+			return nil, err
+		}
+		files[a.Name] = data
+	}
+	manifest := Manifest{}
+	for _, a := range Assets {
+		target := filepath.Join(dir, filepath.FromSlash(a.Name))
+		err := os.MkdirAll(filepath.Dir(target), 0o755)
+		if err == nil {
+			err = os.WriteFile(target, files[a.Name], 0o644)
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifest[a.Name] = a.Integrity
+	}
+	return manifest, nil
+}
+
+func download(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, maxAssetSize))
+}
+
+func readFile(fsys http.FileSystem, name string) ([]byte, error) {
+	f, err := fsys.Open(path.Join("/", name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, maxAssetSize))
+}
+
+// Verify checks that fsys holds every asset and that each matches the hash pinned in Assets
+func Verify(fsys http.FileSystem) (Manifest, error) {
+	manifest := Manifest{}
+	for _, a := range Assets {
+		data, err := readFile(fsys, a.Name)
+		if err != nil {
+			return nil, fmt.Errorf("sandbox: assets are not vendored, run pflow sandbox vendor: %w", err)
+		}
+		if err = a.check(data); err != nil {
+			return nil, err
+		}
+		manifest[a.Name] = a.Integrity
+	}
+	return manifest, nil
+}
+
+// Names lists the assets of a manifest in a stable order
+func (m Manifest) Names() []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,111 @@
+package sandbox
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// cdn answers every pinned url with its own address so each asset has distinct content
+var cdn = &http.Client{Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Body:       io.NopCloser(strings.NewReader("/* " + r.URL.String() + " */")),
+		Request:    r,
+	}, nil
+})}
+
+func TestAssetsPinned(t *testing.T) {
+	for _, a := range Assets {
+		if !strings.HasPrefix(a.Integrity, "sha384-") {
+			t.Errorf("%s is not pinned, run pflow sandbox pin and copy its reviewed hash into Assets", a.Name)
+		}
+	}
+}
+
+// pinCdn replaces the pinned hashes with those of the fake cdn until the test ends
+func pinCdn(t *testing.T) {
+	pinned := Assets
+	t.Cleanup(func() { Assets = pinned })
+	Assets = make([]Asset, len(pinned))
+	for i, a := range pinned {
+		a.Integrity = Integrity([]byte("/* " + a.Url + " */"))
+		Assets[i] = a
+	}
+}
+
+func TestVendor(t *testing.T) {
+	pinCdn(t)
+	dir := t.TempDir()
+	manifest, err := Vendor(context.Background(), cdn, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != len(Assets) || manifest["ace/ace.js"] != Assets[3].Integrity {
+		t.Fatalf("unexpected manifest %v", manifest)
+	}
+	verified, err := Verify(http.Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified["pflow.js"] != manifest["pflow.js"] {
+		t.Fatalf("expected the pinned hashes, got %v", verified)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "pflow.js"), []byte("alert(1)"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Verify(http.Dir(dir)); err == nil || !strings.Contains(err.Error(), "pflow.js does not match") {
+		t.Fatalf("expected a tampered asset to fail, got %v", err)
+	}
+	_ = os.Remove(filepath.Join(dir, "pflow.js"))
+	if _, err = Verify(http.Dir(dir)); err == nil {
+		t.Fatal("expected a missing asset to fail")
+	}
+	if _, err = Verify(http.Dir(t.TempDir())); err == nil || !strings.Contains(err.Error(), "pflow sandbox vendor") {
+		t.Fatalf("expected a hint to vendor the assets, got %v", err)
+	}
+}
+
+func TestVendorMismatch(t *testing.T) {
+	pinCdn(t)
+	Assets[len(Assets)-1].Integrity = Integrity([]byte("alert(1)"))
+	dir := t.TempDir()
+	_, err := Vendor(context.Background(), cdn, dir)
+	if err == nil || !strings.Contains(err.Error(), "pflow.js does not match") {
+		t.Fatalf("expected a changed download to fail, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected nothing to be written, got %v", entries)
+	}
+	Assets[0].Integrity = ""
+	if _, err = Vendor(context.Background(), cdn, dir); err == nil || !strings.Contains(err.Error(), "no pinned integrity") {
+		t.Fatalf("expected an unpinned asset to fail, got %v", err)
+	}
+	manifest, err := Pin(context.Background(), cdn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest["jquery.min.js"] != Integrity([]byte("/* "+Assets[0].Url+" */")) {
+		t.Fatalf("expected pin to report the served hashes, got %v", manifest)
+	}
+}
+
+func TestIntegrity(t *testing.T) {
+	// sha384 of "alert('Hello, world.');" from the subresource integrity spec
+	if got := Integrity([]byte("alert('Hello, world.');")); got != "sha384-H8BRh8j48O9oYatfu5AZzq6A9RINhZO5H16dQZngK7T62em8MUt1FLm52t+eX6xO" {
+		t.Fatalf("unexpected integrity %s", got)
+	}
+}
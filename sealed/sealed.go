@@ -0,0 +1,106 @@
+package sealed
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"strings"
+)
+
+// sealed models are stored in base64_zipped as prefix + base64(salt | nonce | ciphertext)
+// the key is derived from the share secret so the server never stores it
+
+const (
+	Prefix     = "sealed:v1:"
+	saltSize   = 16
+	keySize    = 32
+	secretSize = 24
+	keyInfo    = "pflow private model"
+)
+
+var (
+	ErrNotSealed   = errors.New("sealed: data is not sealed")
+	ErrBadSecret   = errors.New("sealed: wrong secret or corrupt data")
+	ErrEmptySecret = errors.New("sealed: secret must not be empty")
+)
+
+// Is reports whether data was produced by Seal
+func Is(data string) bool {
+	return strings.HasPrefix(data, Prefix)
+}
+
+// NewSecret returns a random url-safe share secret
+func NewSecret() string {
+	b := make([]byte, secretSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newAead(secret string, salt []byte) (cipher.AEAD, error) {
+	if secret == "" {
+		return nil, ErrEmptySecret
+	}
+	key := make([]byte, keySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), salt, []byte(keyInfo)), key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts plaintext with a key derived from secret
+func Seal(secret string, plaintext string) (string, error) {
+	salt := make([]byte, saltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAead(secret, salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	out := append(salt, nonce...)
+	out = aead.Seal(out, nonce, []byte(plaintext), []byte(Prefix))
+	return Prefix + base64.StdEncoding.EncodeToString(out), nil
+}
+
+// Open decrypts data produced by Seal
+func Open(secret string, data string) (string, error) {
+	if !Is(data) {
+		return "", ErrNotSealed
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(data, Prefix))
+	if err != nil || len(raw) < saltSize {
+		return "", ErrBadSecret
+	}
+	aead, err := newAead(secret, raw[:saltSize])
+	if err != nil {
+		return "", err
+	}
+	raw = raw[saltSize:]
+	if len(raw) < aead.NonceSize() {
+		return "", ErrBadSecret
+	}
+	plaintext, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte(Prefix))
+	if err != nil {
+		return "", ErrBadSecret
+	}
+	return string(plaintext), nil
+}
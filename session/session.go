@@ -0,0 +1,264 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/pflow-dev/go-metamodel/v2/metamodel"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFull   = errors.New("session: too many running sessions")
+	ErrClosed = errors.New("session: manager is closed")
+)
+
+// State is sent to subscribers after every fired transition
+type State struct {
+	Session string           `json:"session"`
+	Cid     string           `json:"cid"`
+	Seq     int64            `json:"seq"`
+	Action  string           `json:"action,omitempty"` // the transition that produced this state
+	Tokens  map[string]int64 `json:"tokens"`
+	Vector  []int64          `json:"vector"`
+	Enabled []string         `json:"enabled"` // transitions that can fire from this state
+}
+
+// FireError explains why a transition could not fire, e.g. underflow or an inhibitor arc
+type FireError struct {
+	Action string
+	Reason string
+}
+
+func (e *FireError) Error() string {
+	return "cannot fire " + e.Action + ": " + e.Reason
+}
+
+// Session is a running instance of a model shared by every client that knows its id
+type Session struct {
+	id          string
+	cid         string
+	mm          metamodel.MetaModel
+	mu          sync.Mutex
+	process     metamodel.Process
+	seq         int64
+	action      string
+	lastUsed    time.Time
+	subscribers map[chan State]struct{}
+	closed      bool
+}
+
+func (s *Session) ID() string {
+	return s.id
+}
+
+func (s *Session) Cid() string {
+	return s.cid
+}
+
+// state must be called with s.mu held
+func (s *Session) state() State {
+	net := s.mm.Net()
+	vector := s.process.GetState()
+	st := State{
+		Session: s.id,
+		Cid:     s.cid,
+		Seq:     s.seq,
+		Action:  s.action,
+		Tokens:  make(map[string]int64, len(net.Places)),
+		Vector:  vector,
+		Enabled: []string{},
+	}
+	for label, p := range net.Places {
+		st.Tokens[label] = vector[p.Offset]
+	}
+	for label := range net.Transitions {
+		if ok, _, _ := s.process.TestFire(metamodel.Op{Action: label}); ok {
+			st.Enabled = append(st.Enabled, label)
+		}
+	}
+	sort.Strings(st.Enabled)
+	return st
+}
+
+func (s *Session) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state()
+}
+
+// Fire applies a transition and broadcasts the new state, role is only checked when set
+func (s *Session) Fire(action string, multiple int64, role string) (State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return State{}, ErrClosed
+	}
+	op := metamodel.Op{Action: action, Multiple: multiple, Role: role}
+	if ok, msg, _ := s.process.TestFire(op); !ok {
+		return s.state(), &FireError{Action: action, Reason: msg}
+	}
+	s.process.Fire(op)
+	s.seq++
+	s.action = action
+	s.lastUsed = time.Now()
+	st := s.state()
+	for ch := range s.subscribers {
+		publish(ch, st)
+	}
+	return st, nil
+}
+
+// publish replaces an unread state so slow subscribers only ever see the latest one
+func publish(ch chan State, st State) {
+	select {
+	case ch <- st:
+		return
+	default:
+	}
+	select {
+	case <-ch:
+	default:
+	}
+	select {
+	case ch <- st:
+	default:
+	}
+}
+
+// Subscribe returns a channel that receives the current state and then every change,
+// it is closed when the session ends or cancel is called
+func (s *Session) Subscribe() (<-chan State, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan State, 1)
+	if s.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	ch <- s.state()
+	s.subscribers[ch] = struct{}{}
+	s.lastUsed = time.Now()
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subscribers[ch]; ok {
+			delete(s.subscribers, ch)
+			close(ch)
+			s.lastUsed = time.Now()
+		}
+	}
+}
+
+func (s *Session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for ch := range s.subscribers {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (s *Session) idleSince(t time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers) == 0 && s.lastUsed.Before(t)
+}
+
+// Manager holds running sessions in memory, sessions without subscribers expire after idle
+type Manager struct {
+	mu       sync.Mutex
+	max      int
+	idle     time.Duration
+	sessions map[string]*Session
+	closed   bool
+}
+
+func NewManager(max int, idle time.Duration) *Manager {
+	return &Manager{
+		max:      max,
+		idle:     idle,
+		sessions: map[string]*Session{},
+	}
+}
+
+// Create starts a session from the initial state of mm
+func (m *Manager) Create(cid string, mm metamodel.MetaModel) (*Session, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	if len(m.sessions) >= m.max {
+		m.expire()
+	}
+	if len(m.sessions) >= m.max {
+		return nil, ErrFull
+	}
+	s := &Session{
+		id:          hex.EncodeToString(b),
+		cid:         cid,
+		mm:          mm,
+		process:     mm.Execute(),
+		lastUsed:    time.Now(),
+		subscribers: map[chan State]struct{}{},
+	}
+	m.sessions[s.id] = s
+	return s, nil
+}
+
+// expire must be called with m.mu held
+func (m *Manager) expire() {
+	cutoff := time.Now().Add(-m.idle)
+	for id, s := range m.sessions {
+		if s.idleSince(cutoff) {
+			s.close()
+			delete(m.sessions, id)
+		}
+	}
+}
+
+func (m *Manager) Get(id string) (*Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	return s, ok
+}
+
+// Remove ends a session and disconnects its subscribers
+func (m *Manager) Remove(id string) bool {
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	if ok {
+		s.close()
+	}
+	return ok
+}
+
+func (m *Manager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+// Close ends every session, it is registered to run when the http server shuts down
+// so event streams do not hold the shutdown open
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	for id, s := range m.sessions {
+		s.close()
+		delete(m.sessions, id)
+	}
+}
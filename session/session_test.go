@@ -0,0 +1,68 @@
+package session
+
+import (
+	"errors"
+	"github.com/pflow-dev/go-metamodel/v2/metamodel"
+	. "github.com/pflow-dev/pflow-cli/internal/examples"
+	"strings"
+	"testing"
+	"time"
+)
+
+func inhibitorTest(t *testing.T) metamodel.MetaModel {
+	mm := metamodel.New()
+	if _, ok := mm.UnpackFromUrl("?z="+InhibitorTest.Base64Zipped, "model.json"); !ok {
+		t.Fatal("failed to unpack model")
+	}
+	return mm
+}
+
+func TestSession(t *testing.T) {
+	m := NewManager(1, time.Minute)
+	s, err := m.Create(InhibitorTest.IpfsCid, inhibitorTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Create(InhibitorTest.IpfsCid, inhibitorTest(t)); !errors.Is(err, ErrFull) {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+
+	updates, cancel := s.Subscribe()
+	defer cancel()
+	initial := <-updates
+	if initial.Tokens["foo"] != 1 || strings.Join(initial.Enabled, ",") != "dec,inc" {
+		t.Fatalf("unexpected initial state %+v", initial)
+	}
+
+	st, err := s.Fire("dec", 1, "")
+	if err != nil || st.Seq != 1 || st.Tokens["foo"] != 0 || strings.Join(st.Enabled, ",") != "baz,inc" {
+		t.Fatalf("unexpected state after dec: %+v %v", st, err)
+	}
+	if got := <-updates; got.Seq != 1 || got.Action != "dec" {
+		t.Fatalf("subscriber missed the update: %+v", got)
+	}
+	fireErr := &FireError{}
+	if _, err = s.Fire("dec", 1, ""); !errors.As(err, &fireErr) || s.State().Seq != 1 {
+		t.Fatalf("expected underflow, got %v", err)
+	}
+
+	m.Remove(s.ID())
+	if _, open := <-updates; open {
+		t.Fatal("expected subscription to close with the session")
+	}
+	if _, err = s.Fire("inc", 1, ""); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	s, _ := NewManager(1, time.Minute).Create(InhibitorTest.IpfsCid, inhibitorTest(t))
+	updates, cancel := s.Subscribe()
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		_, _ = s.Fire("inc", 1, "")
+	}
+	if got := <-updates; got.Seq != 2 || got.Tokens["foo"] != 3 {
+		t.Fatalf("expected only the latest state, got %+v", got)
+	}
+}
@@ -0,0 +1,248 @@
+package snippet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dop251/goja"
+	"github.com/pflow-dev/go-metamodel/v2/metamodel"
+	"math"
+	"runtime/metrics"
+	"time"
+)
+
+// snippets are declaration.js source, either a model.json object assigned to declaration,
+// the form CheckForSnippet stores, or a function that builds the model with the dsl below
+
+const (
+	DefaultTimeout = time.Second
+	DefaultMemory  = 64 << 20
+	MaxSource      = 256 << 10
+	Workers        = 4 // evaluations running at once, more wait for a worker until their timeout
+	maxCallStack   = 1024
+	memoryPoll     = 5 * time.Millisecond
+	heapMetric     = "/memory/classes/heap/objects:bytes"
+)
+
+var (
+	ErrTimeout       = errors.New("snippet: timed out")
+	ErrMemory        = errors.New("snippet: memory limit exceeded")
+	ErrHeap          = errors.New("snippet: the server heap grew past the memory limit, try again later")
+	ErrSource        = fmt.Errorf("snippet: source is larger than %d bytes", MaxSource)
+	ErrNoDeclaration = errors.New("snippet: declaration is not defined")
+)
+
+// Limits bound a single evaluation, zero values use the defaults
+type Limits struct {
+	Timeout time.Duration
+	Memory  uint64 // largest single string or array a snippet may allocate, see guard
+}
+
+// declare calls a declaration function with fn, cell and role and collects the model.json it builds,
+// e.g. cell("foo", 1, 3, {x: 250, y: 250}), fn("inc", role("default"), {x: 200, y: 200}).tx(1, foo)
+const declare = `(function (declaration) {
+	const model = {modelType: "petriNet", version: "v0", places: {}, transitions: {}, arcs: []};
+	let offset = 0;
+	const node = (label) => ({
+		label,
+		tx(weight, target) {
+			model.arcs.push({source: label, target: target.label, weight: weight || 1});
+			return this;
+		},
+		guard(weight, target) {
+			model.arcs.push({source: label, target: target.label, weight: weight || 1, inhibit: true});
+			return this;
+		},
+	});
+	const role = (label) => ({label});
+	const cell = (label, initial, capacity, position) => {
+		const {x, y} = position || {};
+		model.places[label] = {offset: offset++, initial: initial || 0, capacity: capacity || 0, x: x || 0, y: y || 0};
+		return node(label);
+	};
+	const fn = (label, r, position) => {
+		const {x, y} = position || {};
+		model.transitions[label] = {role: (r && r.label) || r || "default", x: x || 0, y: y || 0};
+		return node(label);
+	};
+	declaration({fn, cell, role});
+	return model;
+})`
+
+const result = `(function () {
+	if (typeof declaration === "undefined") {
+		return undefined;
+	}
+	return JSON.stringify(typeof declaration === "function" ? ` + declare + `(declaration) : declaration);
+})()`
+
+// guard replaces the builtins that allocate a string or array of a requested size with versions
+// that ask check for the size in bytes first, so "x".repeat(1 << 30) fails before it allocates,
+// the constructor on Array.prototype is replaced too so [].constructor(n) does not bypass it
+const guard = `(function (check) {
+	const define = (target, name, value) =>
+		Object.defineProperty(target, name, {value, writable: false, enumerable: false, configurable: false});
+	const wrap = (target, name, size) => {
+		const original = target[name];
+		define(target, name, function (...args) {
+			check(size(this, args));
+			return original.apply(this, args);
+		});
+	};
+	const chars = (n) => (Number(n) || 0) * 2;
+	const elements = (n) => (Number(n) || 0) * 16;
+	wrap(String.prototype, "repeat", (s, [count]) => chars(String(s).length) * (Number(count) || 0));
+	wrap(String.prototype, "padStart", (s, [length]) => chars(length));
+	wrap(String.prototype, "padEnd", (s, [length]) => chars(length));
+	wrap(Array.prototype, "fill", (a) => elements(a.length));
+	wrap(Array.prototype, "join", (a, [separator]) => chars(a.length) * (separator === undefined ? 1 : String(separator).length + 1));
+	const sized = (args) => args.length === 1 && typeof args[0] === "number" ? elements(args[0]) : 0;
+	const original = Array;
+	wrap(original, "from", (a, [items]) => elements(items && items.length));
+	const array = function Array(...args) {
+		check(sized(args));
+		return new.target ? Reflect.construct(original, args, new.target) : original(...args);
+	};
+	array.prototype = original.prototype; // instanceof and subclasses see the builtin prototype
+	Object.setPrototypeOf(array, original); // and isArray, of and from
+	define(Array.prototype, "constructor", array);
+	define(globalThis, "Array", array);
+})`
+
+// running holds a slot per worker so snippets that spin until their timeout cannot take every core
+var running = make(chan struct{}, Workers)
+
+// Eval runs declaration.js source in a fresh interpreter and returns the model it declares,
+// it is interrupted when ctx is done, after the timeout or when a guarded builtin is asked
+// for more than the memory limit
+func Eval(ctx context.Context, source string, limits Limits) (mm metamodel.MetaModel, err error) {
+	if limits.Timeout <= 0 {
+		limits.Timeout = DefaultTimeout
+	}
+	if limits.Memory == 0 {
+		limits.Memory = DefaultMemory
+	}
+	if len(source) > MaxSource {
+		return nil, ErrSource
+	}
+	ctx, cancel := context.WithTimeout(ctx, limits.Timeout)
+	defer cancel()
+	if ctx.Err() != nil {
+		return nil, ErrTimeout
+	}
+	select {
+	case running <- struct{}{}:
+		defer func() { <-running }()
+	case <-ctx.Done():
+		return nil, ErrTimeout
+	}
+
+	vm := goja.New()
+	vm.SetMaxCallStackSize(maxCallStack)
+	console := vm.NewObject()
+	for _, name := range []string{"log", "info", "warn", "error", "debug"} {
+		_ = console.Set(name, func(goja.FunctionCall) goja.Value { return goja.Undefined() })
+	}
+	_ = vm.Set("console", console)
+	err = limitAllocations(vm, limits.Memory)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go watch(ctx, vm, limits.Memory, done)
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("snippet: %v", r)
+		}
+	}()
+	_, err = vm.RunScript("declaration.js", source)
+	var out goja.Value
+	if err == nil {
+		out, err = vm.RunString(result)
+	}
+	if err != nil {
+		var interrupted *goja.InterruptedError
+		if errors.As(err, &interrupted) {
+			if cause, ok := interrupted.Value().(error); ok {
+				return nil, cause
+			}
+		}
+		if errors.Is(err, ErrMemory) {
+			return nil, ErrMemory
+		}
+		var overflow *goja.StackOverflowError
+		if errors.As(err, &overflow) {
+			return nil, fmt.Errorf("snippet: call stack exceeded %d frames", maxCallStack)
+		}
+		return nil, fmt.Errorf("snippet: %w", err)
+	}
+	if goja.IsUndefined(out) {
+		return nil, ErrNoDeclaration
+	}
+	return load(out.String())
+}
+
+// limitAllocations installs guard, an oversized request interrupts vm so the snippet cannot catch it
+func limitAllocations(vm *goja.Runtime, limit uint64) error {
+	install, err := vm.RunString(guard)
+	if err != nil {
+		return fmt.Errorf("snippet: %w", err)
+	}
+	fn, _ := goja.AssertFunction(install)
+	check := func(call goja.FunctionCall) goja.Value {
+		if size := call.Argument(0).ToFloat(); math.IsNaN(size) || size > float64(limit) {
+			vm.Interrupt(ErrMemory)
+			panic(vm.NewGoError(ErrMemory))
+		}
+		return goja.Undefined()
+	}
+	_, err = fn(goja.Undefined(), vm.ToValue(check))
+	if err != nil {
+		return fmt.Errorf("snippet: %w", err)
+	}
+	return nil
+}
+
+// watch interrupts vm when ctx ends, and as a backstop for allocations guard does not cover, when the
+// heap grows more than limit bytes, the heap is shared by the process so other work can cause ErrHeap,
+// unlike ErrMemory it says nothing certain about the snippet
+func watch(ctx context.Context, vm *goja.Runtime, limit uint64, done <-chan struct{}) {
+	sample := []metrics.Sample{{Name: heapMetric}}
+	metrics.Read(sample)
+	start := sample[0].Value.Uint64()
+	ticker := time.NewTicker(memoryPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			vm.Interrupt(ErrTimeout)
+			return
+		case <-ticker.C:
+			metrics.Read(sample)
+			if heap := sample[0].Value.Uint64(); heap > start && heap-start > limit {
+				vm.Interrupt(ErrHeap)
+				return
+			}
+		}
+	}
+}
+
+// load parses model.json with metamodel, which panics on arcs between unknown nodes
+func load(modelJson string) (mm metamodel.MetaModel, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("snippet: invalid model: %v", r)
+		}
+	}()
+	zipped, _ := metamodel.ToEncodedZip([]byte(modelJson), "model.json")
+	mm = metamodel.New()
+	if _, ok := mm.UnpackFromUrl("?z="+zipped, "model.json"); !ok {
+		return nil, errors.New("snippet: invalid model")
+	}
+	return mm, nil
+}
@@ -0,0 +1,139 @@
+package snippet
+
+import (
+	"context"
+	"errors"
+	"github.com/pflow-dev/go-metamodel/v2/metamodel"
+	. "github.com/pflow-dev/pflow-cli/internal/examples"
+	"strings"
+	"testing"
+	"time"
+)
+
+const counter = `
+function declaration({fn, cell, role}) {
+	const r = role("default");
+	const foo = cell("foo", 1, 3, {x: 250, y: 250});
+	const bar = cell("bar", 0, 0, {x: 350, y: 250});
+	fn("inc", r, {x: 200, y: 200}).tx(1, foo);
+	const dec = fn("dec", r, {x: 300, y: 200});
+	foo.tx(1, dec);
+	dec.tx(2, bar);
+	bar.guard(1, fn("halt", "admin", {x: 400, y: 200}));
+	console.log("declared");
+}
+`
+
+func TestEvalFunction(t *testing.T) {
+	mm, err := Eval(context.Background(), counter, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	net := mm.Net()
+	if len(net.Places) != 2 || len(net.Transitions) != 3 || len(net.Arcs) != 4 {
+		t.Fatalf("unexpected net %+v", mm.ToDeclarationObject())
+	}
+	if p := net.Places["foo"]; p.Initial != 1 || p.Capacity != 3 || p.X != 250 || p.Offset != 0 {
+		t.Fatalf("unexpected place %+v", p)
+	}
+	if role := net.Transitions["halt"].Role.Label; role != "admin" {
+		t.Fatalf("expected the admin role, got %s", role)
+	}
+	if ok, _, _ := mm.Execute().Fire(metamodel.Op{Action: "dec", Multiple: 1, Role: "default"}); !ok {
+		t.Fatal("expected dec to fire from the initial state")
+	}
+}
+
+func TestEvalObject(t *testing.T) {
+	source, ok := metamodel.UnzipUrl("?z="+InhibitorTest.Base64Zipped, "model.json")
+	if !ok {
+		t.Fatal("failed to unzip model")
+	}
+	// the form CheckForSnippet stores when a model is opened in the sandbox
+	mm, err := Eval(context.Background(), "const declaration = "+source, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := metamodel.New()
+	want.UnpackFromUrl("?z="+InhibitorTest.Base64Zipped, "model.json")
+	if len(mm.Net().Places) != len(want.Net().Places) || len(mm.Net().Arcs) != len(want.Net().Arcs) {
+		t.Fatalf("expected the declared model, got %+v", mm.ToDeclarationObject())
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	for source, want := range map[string]string{
+		"let x = 1":             ErrNoDeclaration.Error(),
+		"const declaration = {": "SyntaxError",
+		"function declaration() { throw 'broken' }":                        "broken",
+		"function declaration({fn}) { fn('a').tx(1, {label: 'missing'}) }": "invalid model",
+		"function declaration() { declaration() }":                         "call stack exceeded",
+		"window.alert(1)": "window is not defined",
+	} {
+		_, err := Eval(context.Background(), source, Limits{})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected %q, got %v", source, want, err)
+		}
+	}
+}
+
+func TestEvalLimits(t *testing.T) {
+	start := time.Now()
+	_, err := Eval(context.Background(), "while (true) {}", Limits{Timeout: 50 * time.Millisecond})
+	if !errors.Is(err, ErrTimeout) || time.Since(start) > time.Second {
+		t.Fatalf("expected a timeout, got %v after %v", err, time.Since(start))
+	}
+	hog := "const keep = []; while (true) { keep.push(new Array(1 << 16).fill(1)) }"
+	_, err = Eval(context.Background(), hog, Limits{Timeout: 10 * time.Second, Memory: 16 << 20})
+	if !errors.Is(err, ErrHeap) {
+		t.Fatalf("expected the heap backstop, got %v", err)
+	}
+	for _, alloc := range []string{
+		`"x".repeat(1 << 30)`,
+		`try { "x".repeat(1 << 30) } catch (e) {} while (true) {}`,
+		`"x".padEnd(1 << 30)`,
+		`new Array(1 << 28)`,
+		`[].constructor(1e9)`,
+		`const a = []; a.length = 1e9; a.fill(0)`,
+		`Array.from({length: 1e9})`,
+	} {
+		start = time.Now()
+		_, err = Eval(context.Background(), alloc, Limits{Timeout: 10 * time.Second})
+		if !errors.Is(err, ErrMemory) || time.Since(start) > time.Second {
+			t.Errorf("%s: expected the allocation to be refused, got %v after %v", alloc, err, time.Since(start))
+		}
+	}
+	builtins := `if (!([] instanceof Array && Array.isArray(new Array(2)) && Array(3).length === 3 &&
+		new (class extends Array {})() instanceof Array && "ab".repeat(2) === "abab")) throw "broken";
+		const declaration = {places: {}, transitions: {}, arcs: []}`
+	if _, err = Eval(context.Background(), builtins, Limits{}); err != nil {
+		t.Fatalf("expected the guarded builtins to behave as usual, got %v", err)
+	}
+	if _, err = Eval(context.Background(), strings.Repeat(" ", MaxSource+1), Limits{}); !errors.Is(err, ErrSource) {
+		t.Fatalf("expected oversized source to be refused, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = Eval(ctx, counter, Limits{}); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected a cancelled context to stop the evaluation, got %v", err)
+	}
+}
+
+func TestEvalWorkers(t *testing.T) {
+	spinning := make(chan error)
+	for i := 0; i < Workers-1; i++ {
+		go func() {
+			_, err := Eval(context.Background(), "while (true) {}", Limits{Timeout: 500 * time.Millisecond})
+			spinning <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := Eval(context.Background(), counter, Limits{Timeout: 200 * time.Millisecond}); err != nil {
+		t.Fatalf("expected a free worker while others spin, got %v", err)
+	}
+	for i := 0; i < Workers-1; i++ {
+		if err := <-spinning; !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected the spinning snippets to time out, got %v", err)
+		}
+	}
+}
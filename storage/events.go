@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+const (
+	eventTable      = "pflow_events"
+	sqliteTimestamp = "2006-01-02 15:04:05"
+)
+
+// Event is a single entry in the append-only event journal
+type Event struct {
+	ID        int64                  `json:"id"`
+	Type      string                 `json:"type"`
+	Params    map[string]interface{} `json:"params"`
+	CreatedAt time.Time              `json:"created"`
+}
+
+// EventQuery selects journal entries, zero values are ignored
+// when Newest is set the last Limit matches are returned instead of the first
+type EventQuery struct {
+	Type    string
+	AfterId int64
+	After   time.Time
+	Limit   int64
+	Newest  bool
+}
+
+func CreateEventTable(db *sql.DB) {
+	createSql := `
+	CREATE TABLE IF NOT EXISTS ` + eventTable + ` (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_type TEXT,
+		params TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS ` + eventTable + `_type ON ` + eventTable + ` (event_type, id);`
+
+	_, err := db.Exec(createSql)
+	if err != nil {
+		panic(err)
+	}
+}
+
+type EventTable struct {
+	db     *sql.DB
+	writer *Writer
+	insert *sql.Stmt
+}
+
+func NewEventTable(db *sql.DB, w *Writer) EventTable {
+	return EventTable{
+		db:     db,
+		writer: w,
+		insert: prepare(db, "INSERT INTO "+eventTable+"(event_type, params) values(?,?)"),
+	}
+}
+
+func (e EventTable) Append(eventType string, params map[string]interface{}) (int64, error) {
+	defer e.writer.observe(eventTable, "append", time.Now())
+	data, err := json.Marshal(params)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = e.writer.Do(func(tx *sql.Tx) error {
+		res, err := tx.Stmt(e.insert).Exec(eventType, string(data))
+		if err != nil {
+			return err
+		}
+		id, err = res.LastInsertId()
+		return err
+	})
+	return id, err
+}
+
+// AppendBatch appends events in one transaction and sets their ids, views are recorded this way
+// so a burst of page hits costs one write instead of one per hit
+func (e EventTable) AppendBatch(events []Event) error {
+	defer e.writer.observe(eventTable, "append", time.Now())
+	params := make([]string, len(events))
+	for i, evt := range events {
+		data, err := json.Marshal(evt.Params)
+		if err != nil {
+			return err
+		}
+		params[i] = string(data)
+	}
+	return e.writer.Do(func(tx *sql.Tx) error {
+		insert := tx.Stmt(e.insert)
+		for i := range events {
+			res, err := insert.Exec(events[i].Type, params[i])
+			if err != nil {
+				return err
+			}
+			events[i].ID, err = res.LastInsertId()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e EventTable) close() {
+	_ = e.insert.Close()
+}
+
+// Query returns matching events in the order they were appended
+func (e EventTable) Query(q EventQuery) ([]Event, error) {
+	defer e.writer.observe(eventTable, "query", time.Now())
+	sqlQuery := "SELECT id, event_type, params, created_at FROM " + eventTable + " WHERE id > ?"
+	args := []interface{}{q.AfterId}
+	if q.Type != "" {
+		sqlQuery += " AND event_type = ?"
+		args = append(args, q.Type)
+	}
+	if !q.After.IsZero() {
+		sqlQuery += " AND created_at > ?"
+		args = append(args, q.After.UTC().Format(sqliteTimestamp))
+	}
+	if q.Newest {
+		sqlQuery += " ORDER BY id DESC"
+	} else {
+		sqlQuery += " ORDER BY id"
+	}
+	if q.Limit > 0 {
+		sqlQuery += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+	rows, err := e.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []Event{}
+	for rows.Next() {
+		var params string
+		evt := Event{}
+		err = rows.Scan(&evt.ID, &evt.Type, &params, &evt.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(params), &evt.Params)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, evt)
+	}
+	if q.Newest {
+		for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+			events[i], events[j] = events[j], events[i]
+		}
+	}
+	return events, rows.Err()
+}
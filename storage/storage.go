@@ -1,11 +1,15 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
+	"errors"
+	"github.com/mattn/go-sqlite3"
 	"github.com/pflow-dev/go-metamodel/v2/model"
-	"github.com/pflow-dev/go-metamodel/v2/server"
 	"log"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -16,6 +20,11 @@ var (
 )
 
 const (
+	// WAL lets readers proceed while the single writer commits,
+	// busy_timeout covers other processes (e.g. cli commands) holding the lock
+	connectionParams = "_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL&_txlock=immediate"
+	blobColumns      = "id, ipfs_cid, base64_zipped, title, description, keywords, referrer, created_at"
+
 	emptyModel    = `UEsDBAoAAAAAAMC5PljjbbhPbAAAAGwAAAAKAAAAbW9kZWwuanNvbnsKICAibW9kZWxUeXBlIjogInBldHJpTmV0IiwKICAidmVyc2lvbiI6ICJ2MCIsCiAgInBsYWNlcyI6IHsKICB9LAogICJ0cmFuc2l0aW9ucyI6IHsKICB9LAogICJhcmNzIjogWwogIF0KfVBLAQIUAAoAAAAAAMC5PljjbbhPbAAAAGwAAAAKAAAAAAAAAAAAAAAAAAAAAABtb2RlbC5qc29uUEsFBgAAAAABAAEAOAAAAJQAAAAAAA==`
 	emptyModelCid = `zb2rhgff9ScJPXQjbHZoCDD8MeYR5DygH6abycdaDKvSkUn2T`
 
@@ -45,11 +54,14 @@ func CreateTables(db *sql.DB) {
 	for _, tableName := range tables {
 		CreateBlobTable(db, tableName)
 	}
+	CreateEventTable(db)
+	CreateTokenTable(db)
+	CreateWebhookTables(db)
 }
 func ResetDb(dbpath string, dropTables ...bool) *sql.DB {
 	db := ConnectDb(dbpath)
 	if len(dropTables) > 0 && dropTables[0] {
-		for _, tableName := range tables {
+		for _, tableName := range append(tables, eventTable, tokenTable, webhookTable, deliveryTable) {
 			_, err := db.Exec("DROP TABLE IF EXISTS " + tableName)
 			if err != nil {
 				panic(err)
@@ -80,7 +92,11 @@ func CreateBlobTable(db *sql.DB, tableName string) {
 }
 
 func ConnectDb(dbPath string) *sql.DB {
-	db, err := sql.Open("sqlite3", dbPath)
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("sqlite3", dbPath+sep+connectionParams)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -88,124 +104,285 @@ func ConnectDb(dbPath string) *sql.DB {
 }
 
 type Storage struct {
-	db      *sql.DB
-	Model   server.BlobAccessor
-	Snippet server.BlobAccessor
+	db       *sql.DB
+	writer   *Writer
+	Model    ModelTable
+	Snippet  SnippetTable
+	Events   EventTable
+	Tokens   TokenTable
+	Webhooks WebhookTable
 }
 
 func New(db *sql.DB) *Storage {
+	w := NewWriter(db)
 	return &Storage{
-		db:      db,
-		Model:   NewModelTable(db),
-		Snippet: NewSnippetTable(db),
+		db:       db,
+		writer:   w,
+		Model:    NewModelTable(db, w),
+		Snippet:  NewSnippetTable(db, w),
+		Events:   NewEventTable(db, w),
+		Tokens:   NewTokenTable(db, w),
+		Webhooks: NewWebhookTable(db, w),
 	}
 }
 
-type ModelTable struct {
-	db *sql.DB
+// ObserveQueries reports the latency of every table call to fn
+func (s *Storage) ObserveQueries(fn QueryObserver) {
+	s.writer.SetObserver(fn)
 }
 
-func NewModelTable(db *sql.DB) ModelTable {
-	return ModelTable{db: db}
+// Ping checks that the database can still be reached
+func (s *Storage) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
 }
 
-func (m ModelTable) Get(id int64) *model.Zblob {
-	row := new(model.Zblob)
-	res := m.db.QueryRow("SELECT * FROM pflow_models WHERE id = ?", id)
-	err := res.Scan(&row.ID, &row.IpfsCid, &row.Base64Zipped, &row.Title, &row.Description, &row.Keywords, &row.Referer, &row.CreatedAt)
-	if err != nil {
-		log.Fatal(err)
+// CheckTables returns an error naming any table that is missing from the database
+func (s *Storage) CheckTables(ctx context.Context) error {
+	missing := []string{}
+	for _, tableName := range append(tables, eventTable, tokenTable, webhookTable, deliveryTable) {
+		var name string
+		err := s.db.QueryRowContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", tableName).Scan(&name)
+		if errors.Is(err, sql.ErrNoRows) {
+			missing = append(missing, tableName)
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New("storage: missing tables " + strings.Join(missing, ", "))
 	}
 	return nil
 }
-func (m ModelTable) GetByCid(cid string) *model.Zblob {
-	row := new(model.Zblob)
-	res := m.db.QueryRow("SELECT * FROM pflow_models WHERE ipfs_cid = ?", cid)
-	err := res.Scan(&row.ID, &row.IpfsCid, &row.Base64Zipped, &row.Title, &row.Description, &row.Keywords, &row.Referer, &row.CreatedAt)
-	if err != nil {
-		return EmptyModel
-	}
-	return row
+
+// Close drains pending writes and closes the database handle
+func (s *Storage) Close() error {
+	s.writer.Close()
+	s.Model.close()
+	s.Snippet.close()
+	s.Events.close()
+	s.Tokens.close()
+	s.Webhooks.close()
+	return s.db.Close()
 }
-func (m ModelTable) GetMaxId() int64 {
-	row := m.db.QueryRow("SELECT MAX(id) FROM pflow_models")
-	var maxId int64
-	err := row.Scan(&maxId)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return maxId
+
+// blobTable holds the prepared statements shared by model and snippet tables
+type blobTable struct {
+	name       string
+	empty      *model.Zblob
+	writer     *Writer
+	created    atomic.Uint64
+	duplicates atomic.Uint64
+	get        *sql.Stmt
+	getByCid   *sql.Stmt
+	idByCid    *sql.Stmt
+	maxId      *sql.Stmt
+	list       *sql.Stmt
+	insert     *sql.Stmt
+	update     *sql.Stmt
+	remove     *sql.Stmt
 }
-func (m ModelTable) Create(ipfsCid, base64Zipped, title, description, keywords, referrer string) (int64, error) {
-	stmt, err := m.db.Prepare("INSERT INTO pflow_models(ipfs_cid, base64_zipped, title, description, keywords, referrer) values(?,?,?,?,?,?)")
-	if err != nil {
-		log.Fatal(err)
-	}
-	res, err := stmt.Exec(ipfsCid, base64Zipped, title, description, keywords, referrer)
-	if err != nil {
-		if err.Error() == "UNIQUE constraint failed: pflow_models.ipfs_cid" {
-			return m.GetByCid(ipfsCid).ID, nil
-		}
+
+func newBlobTable(db *sql.DB, w *Writer, tableName string, empty *model.Zblob) *blobTable {
+	return &blobTable{
+		name:     tableName,
+		empty:    empty,
+		writer:   w,
+		get:      prepare(db, "SELECT "+blobColumns+" FROM "+tableName+" WHERE id = ?"),
+		getByCid: prepare(db, "SELECT "+blobColumns+" FROM "+tableName+" WHERE ipfs_cid = ?"),
+		idByCid:  prepare(db, "SELECT id FROM "+tableName+" WHERE ipfs_cid = ?"),
+		maxId:    prepare(db, "SELECT MAX(id) FROM "+tableName),
+		list:     prepare(db, "SELECT "+blobColumns+" FROM "+tableName+" ORDER BY id LIMIT ? OFFSET ?"),
+		insert:   prepare(db, "INSERT INTO "+tableName+"(ipfs_cid, base64_zipped, title, description, keywords, referrer) values(?,?,?,?,?,?)"),
+		update:   prepare(db, "UPDATE "+tableName+" SET title = ?, description = ?, keywords = ? WHERE ipfs_cid = ?"),
+		remove:   prepare(db, "DELETE FROM "+tableName+" WHERE ipfs_cid = ?"),
 	}
-	id, err := res.LastInsertId()
+}
+
+func prepare(db *sql.DB, query string) *sql.Stmt {
+	stmt, err := db.Prepare(query)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return id, nil
+	return stmt
 }
 
-type SnippetTable struct {
-	db *sql.DB
+type scanner interface {
+	Scan(dest ...any) error
 }
 
-func NewSnippetTable(db *sql.DB) SnippetTable {
-	return SnippetTable{db: db}
-}
-
-func (m SnippetTable) Get(id int64) *model.Zblob {
-	row := m.db.QueryRow("SELECT * FROM pflow_snippets WHERE id = ?", id)
+func scanBlob(row scanner) (*model.Zblob, error) {
 	zblob := new(model.Zblob)
 	err := row.Scan(&zblob.ID, &zblob.IpfsCid, &zblob.Base64Zipped, &zblob.Title, &zblob.Description, &zblob.Keywords, &zblob.Referer, &zblob.CreatedAt)
+	return zblob, err
+}
+
+// BlobCounts reports inserts since the table was opened
+type BlobCounts struct {
+	Created    uint64 // new rows
+	Duplicates uint64 // inserts of a cid that was already stored
+}
+
+func (t *blobTable) Counts() BlobCounts {
+	return BlobCounts{Created: t.created.Load(), Duplicates: t.duplicates.Load()}
+}
+
+func (t *blobTable) Get(id int64) *model.Zblob {
+	defer t.writer.observe(t.name, "get", time.Now())
+	zblob, err := scanBlob(t.get.QueryRow(id))
 	if err != nil {
 		log.Fatal(err)
 	}
 	return zblob
 }
 
-func (m SnippetTable) GetByCid(cid string) *model.Zblob {
-	row := m.db.QueryRow("SELECT * FROM pflow_snippets WHERE ipfs_cid = ?", cid)
-	zblob := new(model.Zblob)
-	err := row.Scan(&zblob.ID, &zblob.IpfsCid, &zblob.Base64Zipped, &zblob.Title, &zblob.Description, &zblob.Keywords, &zblob.Referer, &zblob.CreatedAt)
+func (t *blobTable) GetByCid(cid string) *model.Zblob {
+	defer t.writer.observe(t.name, "getByCid", time.Now())
+	zblob, err := scanBlob(t.getByCid.QueryRow(cid))
 	if err != nil {
-		return EmptySnippet
+		return t.empty
 	}
 	return zblob
 }
 
-func (m SnippetTable) GetMaxId() int64 {
-	row := m.db.QueryRow("SELECT MAX(id) FROM pflow_snippets")
-	var maxId int64
-	err := row.Scan(&maxId)
+func (t *blobTable) GetMaxId() int64 {
+	defer t.writer.observe(t.name, "maxId", time.Now())
+	var maxId sql.NullInt64
+	err := t.maxId.QueryRow().Scan(&maxId)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return maxId
+	return maxId.Int64
 }
 
-func (m SnippetTable) Create(ipfsCid, base64Zipped, title, description, keywords, referrer string) (int64, error) {
-	stmt, err := m.db.Prepare("INSERT INTO pflow_snippets(ipfs_cid, base64_zipped, title, description, keywords, referrer) values(?,?,?,?,?,?)")
+// List returns up to limit rows ordered by id, skipping the first offset rows
+func (t *blobTable) List(offset, limit int64) []*model.Zblob {
+	defer t.writer.observe(t.name, "list", time.Now())
+	rows, err := t.list.Query(limit, offset)
 	if err != nil {
 		log.Fatal(err)
 	}
-	res, err := stmt.Exec(ipfsCid, base64Zipped, title, description, keywords, referrer)
-	if err != nil {
-		if err.Error() == "UNIQUE constraint failed: pflow_snippets.ipfs_cid" {
-			return m.GetByCid(ipfsCid).ID, nil
+	defer rows.Close()
+	blobs := []*model.Zblob{}
+	for rows.Next() {
+		zblob, err := scanBlob(rows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		blobs = append(blobs, zblob)
+	}
+	return blobs
+}
+
+// Create inserts a row through the writer queue, an existing cid returns the stored id
+func (t *blobTable) Create(ipfsCid, base64Zipped, title, description, keywords, referrer string) (id int64, err error) {
+	defer t.writer.observe(t.name, "create", time.Now())
+	var created bool
+	err = t.writer.Do(func(tx *sql.Tx) error {
+		id, created, err = t.insertRow(tx, ipfsCid, base64Zipped, title, description, keywords, referrer)
+		return err
+	})
+	if err == nil {
+		t.count(created)
+	}
+	return id, err
+}
+
+// CreateBatch inserts many rows in a single transaction, existing cids are skipped
+func (t *blobTable) CreateBatch(blobs []*model.Zblob) error {
+	defer t.writer.observe(t.name, "createBatch", time.Now())
+	var results []bool
+	err := t.writer.Do(func(tx *sql.Tx) error {
+		results = results[:0]
+		for _, z := range blobs {
+			_, created, err := t.insertRow(tx, z.IpfsCid, z.Base64Zipped, z.Title, z.Description, z.Keywords, z.Referer)
+			if err != nil {
+				return err
+			}
+			results = append(results, created)
+		}
+		return nil
+	})
+	if err == nil {
+		for _, created := range results {
+			t.count(created)
 		}
 	}
-	id, err := res.LastInsertId()
+	return err
+}
+
+func (t *blobTable) count(created bool) {
+	if created {
+		t.created.Add(1)
+	} else {
+		t.duplicates.Add(1)
+	}
+}
+
+// insertRow returns the id of the new row, or of the existing row with created false
+func (t *blobTable) insertRow(tx *sql.Tx, ipfsCid, base64Zipped, title, description, keywords, referrer string) (id int64, created bool, err error) {
+	res, err := tx.Stmt(t.insert).Exec(ipfsCid, base64Zipped, title, description, keywords, referrer)
+	if isUniqueViolation(err) {
+		err = tx.Stmt(t.idByCid).QueryRow(ipfsCid).Scan(&id)
+		return id, false, err
+	}
 	if err != nil {
-		log.Fatal(err)
+		return 0, false, err
 	}
-	return id, nil
+	id, err = res.LastInsertId()
+	return id, true, err
+}
+
+// Update replaces the metadata of a row, returning false if the cid is not stored
+func (t *blobTable) Update(cid, title, description, keywords string) (found bool, err error) {
+	defer t.writer.observe(t.name, "update", time.Now())
+	err = t.writer.Do(func(tx *sql.Tx) error {
+		found, err = rowsAffected(tx.Stmt(t.update).Exec(title, description, keywords, cid))
+		return err
+	})
+	return found, err
+}
+
+// Delete removes a row, returning false if the cid is not stored
+func (t *blobTable) Delete(cid string) (found bool, err error) {
+	defer t.writer.observe(t.name, "delete", time.Now())
+	err = t.writer.Do(func(tx *sql.Tx) error {
+		found, err = rowsAffected(tx.Stmt(t.remove).Exec(cid))
+		return err
+	})
+	return found, err
+}
+
+func rowsAffected(res sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (t *blobTable) close() {
+	for _, stmt := range []*sql.Stmt{t.get, t.getByCid, t.idByCid, t.maxId, t.list, t.insert, t.update, t.remove} {
+		_ = stmt.Close()
+	}
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+type ModelTable struct {
+	*blobTable
+}
+
+func NewModelTable(db *sql.DB, w *Writer) ModelTable {
+	return ModelTable{newBlobTable(db, w, "pflow_models", EmptyModel)}
+}
+
+type SnippetTable struct {
+	*blobTable
+}
+
+func NewSnippetTable(db *sql.DB, w *Writer) SnippetTable {
+	return SnippetTable{newBlobTable(db, w, "pflow_snippets", EmptySnippet)}
 }
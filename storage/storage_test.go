@@ -1,10 +1,13 @@
 package storage
 
 import (
+	"fmt"
 	"github.com/pflow-dev/go-metamodel/v2/codec"
 	"github.com/pflow-dev/go-metamodel/v2/metamodel"
 	. "github.com/pflow-dev/pflow-cli/internal/examples"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestUnzippingModel(t *testing.T) {
@@ -77,3 +80,130 @@ func TestUnzipSnippet(t *testing.T) {
 		t.Errorf("Failed to unzip SnippetTable")
 	}
 }
+
+func TestEventJournal(t *testing.T) {
+	s := New(ResetDb("/tmp/pflow_test.db", true))
+	for i := 0; i < 3; i++ {
+		_, err := s.Events.Append("modelViewed", map[string]interface{}{"cid": emptyModelCid, "referrer": "https://example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := s.Events.Append("svgRendered", map[string]interface{}{"cid": emptyModelCid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewed, err := s.Events.Query(EventQuery{Type: "modelViewed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(viewed) != 3 || viewed[0].Params["referrer"] != "https://example.com" {
+		t.Fatalf("unexpected events: %+v", viewed)
+	}
+	since, err := s.Events.Query(EventQuery{AfterId: viewed[1].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(since) != 2 || since[1].Type != "svgRendered" {
+		t.Fatalf("unexpected events since %d: %+v", viewed[1].ID, since)
+	}
+	newest, err := s.Events.Query(EventQuery{Limit: 2, Newest: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newest) != 2 || newest[0].ID >= newest[1].ID || newest[1].Type != "svgRendered" {
+		t.Fatalf("unexpected newest events: %+v", newest)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	s := New(ResetDb("/tmp/pflow_test.db", true))
+	token, err := s.Tokens.Create("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Tokens.Valid(token) || s.Tokens.Valid(token+"x") {
+		t.Fatal("expected only the created token to be valid")
+	}
+	var stored int
+	_ = s.db.QueryRow("SELECT count(*) FROM "+tokenTable+" WHERE token_hash = ?", token).Scan(&stored)
+	if stored != 0 {
+		t.Fatal("token must not be stored in plain text")
+	}
+	tokens, err := s.Tokens.List()
+	if err != nil || len(tokens) != 1 || tokens[0].Name != "ci" {
+		t.Fatalf("unexpected tokens: %+v %v", tokens, err)
+	}
+	if err = s.Tokens.Revoke("ci"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Tokens.Valid(token) {
+		t.Fatal("revoked token is still valid")
+	}
+	if err = s.Tokens.Revoke("ci"); err != ErrTokenNotFound {
+		t.Fatalf("expected ErrTokenNotFound, got %v", err)
+	}
+}
+
+func TestWebhookEnqueue(t *testing.T) {
+	s := New(ResetDb("/tmp/pflow_test.db", true))
+	writes := 0
+	s.ObserveQueries(func(table, op string, _ time.Duration) {
+		if op == "enqueue" {
+			writes++
+		}
+	})
+	evt := Event{ID: 1, Type: "modelViewed", CreatedAt: time.Now()}
+	if n, err := s.Webhooks.Enqueue(evt); n != 0 || err != nil || writes != 0 {
+		t.Fatalf("expected no transaction without webhooks, got %d %v after %d writes", n, err, writes)
+	}
+	hook, err := s.Webhooks.Create("https://example.com/hook", []string{"modelViewed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Webhooks.Enqueue(evt); n != 1 || err != nil || writes != 1 {
+		t.Fatalf("expected a created webhook to be seen at once, got %d %v", n, err)
+	}
+	if n, _ := s.Webhooks.Enqueue(Event{ID: 2, Type: "modelDeleted"}); n != 0 || writes != 1 {
+		t.Fatalf("expected no transaction for an unsubscribed event, got %d", n)
+	}
+	if err = s.Webhooks.Remove(hook.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.Webhooks.Enqueue(evt); n != 0 || writes != 1 {
+		t.Fatalf("expected a removed webhook to be dropped at once, got %d", n)
+	}
+}
+
+// BenchmarkCheckForModelTraffic mimics concurrent page views carrying ?z= payloads:
+// every request inserts (usually a duplicate cid) then reads the row back
+func BenchmarkCheckForModelTraffic(b *testing.B) {
+	for _, tc := range []struct {
+		name   string
+		unique int64
+	}{
+		{"duplicates", 3},
+		{"unique", 1 << 62},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			s := New(ResetDb(b.TempDir() + "/bench.db"))
+			defer s.Close()
+			var seq atomic.Int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					cid := fmt.Sprintf("cid-%d", seq.Add(1)%tc.unique)
+					_, err := s.Model.Create(cid, emptyModel, "Untitled", "", "", "http://localhost:8083/p/")
+					if err != nil {
+						b.Fatal(err)
+					}
+					if s.Model.GetByCid(cid).IpfsCid != cid {
+						b.Fatalf("failed to read back %s", cid)
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+		})
+	}
+}
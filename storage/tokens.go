@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+const (
+	tokenTable  = "pflow_tokens"
+	tokenPrefix = "pflow_"
+	tokenBytes  = 32
+)
+
+var ErrTokenNotFound = errors.New("storage: no active token with that id or name")
+
+// Token describes an api token, the secret itself is only returned by Create
+type Token struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created"`
+}
+
+func CreateTokenTable(db *sql.DB) {
+	createSql := `
+	CREATE TABLE IF NOT EXISTS ` + tokenTable + ` (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		token_hash TEXT UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		revoked_at DATETIME
+	);`
+
+	_, err := db.Exec(createSql)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// TokenTable stores sha256 hashes of api tokens, tokens are random so a fast hash is enough
+type TokenTable struct {
+	writer *Writer
+	insert *sql.Stmt
+	revoke *sql.Stmt
+	valid  *sql.Stmt
+	list   *sql.Stmt
+}
+
+func NewTokenTable(db *sql.DB, w *Writer) TokenTable {
+	return TokenTable{
+		writer: w,
+		insert: prepare(db, "INSERT INTO "+tokenTable+"(name, token_hash) values(?,?)"),
+		revoke: prepare(db, "UPDATE "+tokenTable+" SET revoked_at = CURRENT_TIMESTAMP WHERE revoked_at IS NULL AND (id = ? OR name = ?)"),
+		valid:  prepare(db, "SELECT id FROM "+tokenTable+" WHERE token_hash = ? AND revoked_at IS NULL"),
+		list:   prepare(db, "SELECT id, name, created_at FROM "+tokenTable+" WHERE revoked_at IS NULL ORDER BY id"),
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create stores a new token and returns it, it cannot be recovered later
+func (t TokenTable) Create(name string) (string, error) {
+	b := make([]byte, tokenBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	err = t.writer.Do(func(tx *sql.Tx) error {
+		_, err := tx.Stmt(t.insert).Exec(name, hashToken(token))
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Revoke disables every active token matching idOrName
+func (t TokenTable) Revoke(idOrName string) error {
+	id, err := strconv.ParseInt(idOrName, 10, 64)
+	if err != nil {
+		id = -1
+	}
+	var n int64
+	err = t.writer.Do(func(tx *sql.Tx) error {
+		res, err := tx.Stmt(t.revoke).Exec(id, idOrName)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	if err == nil && n == 0 {
+		return ErrTokenNotFound
+	}
+	return err
+}
+
+// Valid reports whether token was created and not revoked
+func (t TokenTable) Valid(token string) bool {
+	defer t.writer.observe(tokenTable, "valid", time.Now())
+	var id int64
+	return t.valid.QueryRow(hashToken(token)).Scan(&id) == nil
+}
+
+func (t TokenTable) List() ([]Token, error) {
+	rows, err := t.list.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []Token{}
+	for rows.Next() {
+		tok := Token{}
+		err = rows.Scan(&tok.ID, &tok.Name, &tok.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+	}
+	return tokens, rows.Err()
+}
+
+func (t TokenTable) close() {
+	_ = t.insert.Close()
+	_ = t.revoke.Close()
+	_ = t.valid.Close()
+	_ = t.list.Close()
+}
@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookTable   = "pflow_webhooks"
+	deliveryTable  = "pflow_webhook_deliveries"
+	webhookPrefix  = "whsec_"
+	webhookReload  = 5 * time.Second // how soon a running server sees webhooks changed by another process
+	deliveryFields = "d.id, d.webhook_id, h.url, h.secret, d.event_id, d.event_type, d.payload, d.status, d.attempts, d.response_code, d.error, d.next_attempt, d.created_at"
+)
+
+// delivery states, a pending delivery is retried until it is delivered or dead
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+var ErrWebhookNotFound = errors.New("storage: no active webhook with that id")
+
+// Webhook receives a signed POST for each event whose type is in Events, or for every event when Events is empty
+type Webhook struct {
+	ID        int64     `json:"id"`
+	Url       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"created"`
+}
+
+// Matches reports whether the webhook subscribes to eventType
+func (h Webhook) Matches(eventType string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery is one event queued for one webhook, Url and Secret are copied from the webhook
+type Delivery struct {
+	ID           int64     `json:"id"`
+	WebhookID    int64     `json:"webhookId"`
+	Url          string    `json:"url"`
+	Secret       string    `json:"-"`
+	EventID      int64     `json:"eventId"`
+	EventType    string    `json:"eventType"`
+	Payload      []byte    `json:"-"`
+	Status       string    `json:"status"`
+	Attempts     int64     `json:"attempts"`
+	ResponseCode int       `json:"responseCode,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	NextAttempt  time.Time `json:"nextAttempt"`
+	CreatedAt    time.Time `json:"created"`
+}
+
+// DeliveryQuery selects the newest deliveries, zero values are ignored
+type DeliveryQuery struct {
+	WebhookID int64
+	Status    string
+	Limit     int64
+}
+
+func CreateWebhookTables(db *sql.DB) {
+	createSql := `
+	CREATE TABLE IF NOT EXISTS ` + webhookTable + ` (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT,
+		secret TEXT,
+		events TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		removed_at DATETIME
+	);
+	CREATE TABLE IF NOT EXISTS ` + deliveryTable + ` (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER,
+		event_id INTEGER,
+		event_type TEXT,
+		payload TEXT,
+		status TEXT,
+		attempts INTEGER DEFAULT 0,
+		response_code INTEGER DEFAULT 0,
+		error TEXT DEFAULT '',
+		next_attempt INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS ` + deliveryTable + `_due ON ` + deliveryTable + ` (status, next_attempt);`
+
+	_, err := db.Exec(createSql)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// webhookCache holds the active webhooks so an event nobody subscribes to does not open a write transaction
+type webhookCache struct {
+	mu       sync.Mutex
+	hooks    []Webhook
+	loadedAt time.Time // zero when the list must be read again
+}
+
+// WebhookTable stores webhooks and their delivery log,
+// the active webhooks are cached, Create and Remove invalidate the cache and it is reloaded after webhookReload
+type WebhookTable struct {
+	db        *sql.DB
+	cache     *webhookCache
+	writer    *Writer
+	insert    *sql.Stmt
+	remove    *sql.Stmt
+	active    *sql.Stmt
+	enqueue   *sql.Stmt
+	due       *sql.Stmt
+	delivered *sql.Stmt
+	failed    *sql.Stmt
+}
+
+func NewWebhookTable(db *sql.DB, w *Writer) WebhookTable {
+	return WebhookTable{
+		db:        db,
+		cache:     &webhookCache{},
+		writer:    w,
+		insert:    prepare(db, "INSERT INTO "+webhookTable+"(url, secret, events) values(?,?,?)"),
+		remove:    prepare(db, "UPDATE "+webhookTable+" SET removed_at = CURRENT_TIMESTAMP WHERE id = ? AND removed_at IS NULL"),
+		active:    prepare(db, "SELECT id, url, secret, events, created_at FROM "+webhookTable+" WHERE removed_at IS NULL ORDER BY id"),
+		enqueue:   prepare(db, "INSERT INTO "+deliveryTable+"(webhook_id, event_id, event_type, payload, status, next_attempt) values(?,?,?,?,?,?)"),
+		due:       prepare(db, "SELECT "+deliveryFields+" FROM "+deliveryTable+" d JOIN "+webhookTable+" h ON h.id = d.webhook_id WHERE d.status = ? AND d.next_attempt <= ? AND h.removed_at IS NULL ORDER BY d.next_attempt, d.id LIMIT ?"),
+		delivered: prepare(db, "UPDATE "+deliveryTable+" SET status = ?, attempts = attempts + 1, response_code = ?, error = '' WHERE id = ?"),
+		failed:    prepare(db, "UPDATE "+deliveryTable+" SET status = ?, attempts = attempts + 1, response_code = ?, error = ?, next_attempt = ? WHERE id = ?"),
+	}
+}
+
+// Create registers url and returns the webhook with the secret used to sign its deliveries
+func (t WebhookTable) Create(url string, events []string) (Webhook, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return Webhook{}, err
+	}
+	hook := Webhook{Url: url, Events: events, Secret: webhookPrefix + hex.EncodeToString(b), CreatedAt: time.Now().UTC()}
+	err = t.writer.Do(func(tx *sql.Tx) error {
+		res, err := tx.Stmt(t.insert).Exec(url, hook.Secret, strings.Join(events, ","))
+		if err != nil {
+			return err
+		}
+		hook.ID, err = res.LastInsertId()
+		return err
+	})
+	t.invalidate()
+	return hook, err
+}
+
+// Remove stops deliveries to a webhook, its delivery log is kept
+func (t WebhookTable) Remove(id int64) error {
+	var found bool
+	err := t.writer.Do(func(tx *sql.Tx) (err error) {
+		found, err = rowsAffected(tx.Stmt(t.remove).Exec(id))
+		return err
+	})
+	t.invalidate()
+	if err == nil && !found {
+		return ErrWebhookNotFound
+	}
+	return err
+}
+
+func scanWebhooks(rows *sql.Rows) ([]Webhook, error) {
+	defer rows.Close()
+	hooks := []Webhook{}
+	for rows.Next() {
+		var events string
+		hook := Webhook{}
+		err := rows.Scan(&hook.ID, &hook.Url, &hook.Secret, &events, &hook.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if events != "" {
+			hook.Events = strings.Split(events, ",")
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+// List returns the active webhooks
+func (t WebhookTable) List() ([]Webhook, error) {
+	defer t.writer.observe(webhookTable, "list", time.Now())
+	rows, err := t.active.Query()
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhooks(rows)
+}
+
+func (t WebhookTable) invalidate() {
+	t.cache.mu.Lock()
+	t.cache.loadedAt = time.Time{}
+	t.cache.mu.Unlock()
+}
+
+// subscribed returns the cached active webhooks that match eventType
+func (t WebhookTable) subscribed(eventType string) ([]Webhook, error) {
+	t.cache.mu.Lock()
+	defer t.cache.mu.Unlock()
+	if t.cache.loadedAt.IsZero() || time.Since(t.cache.loadedAt) > webhookReload {
+		hooks, err := t.List()
+		if err != nil {
+			return nil, err
+		}
+		t.cache.hooks, t.cache.loadedAt = hooks, time.Now()
+	}
+	matched := []Webhook{}
+	for _, hook := range t.cache.hooks {
+		if hook.Matches(eventType) {
+			matched = append(matched, hook)
+		}
+	}
+	return matched, nil
+}
+
+// Enqueue queues evt for every webhook subscribed to its type and returns the number of deliveries,
+// a delivery queued for a webhook removed meanwhile is never sent since Due skips removed webhooks
+func (t WebhookTable) Enqueue(evt Event) (int, error) {
+	hooks, err := t.subscribed(evt.Type)
+	if err != nil || len(hooks) == 0 {
+		return 0, err
+	}
+	defer t.writer.observe(deliveryTable, "enqueue", time.Now())
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		return 0, err
+	}
+	err = t.writer.Do(func(tx *sql.Tx) error {
+		for _, hook := range hooks {
+			_, err := tx.Stmt(t.enqueue).Exec(hook.ID, evt.ID, evt.Type, string(payload), DeliveryPending, evt.CreatedAt.UnixMilli())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(hooks), nil
+}
+
+func scanDeliveries(rows *sql.Rows) ([]Delivery, error) {
+	defer rows.Close()
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var payload string
+		var nextAttempt int64
+		d := Delivery{}
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.Url, &d.Secret, &d.EventID, &d.EventType, &payload,
+			&d.Status, &d.Attempts, &d.ResponseCode, &d.Error, &nextAttempt, &d.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		d.Payload = []byte(payload)
+		d.NextAttempt = time.UnixMilli(nextAttempt).UTC()
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// Due returns up to limit pending deliveries whose next attempt is not after now
+func (t WebhookTable) Due(now time.Time, limit int64) ([]Delivery, error) {
+	defer t.writer.observe(deliveryTable, "due", time.Now())
+	rows, err := t.due.Query(DeliveryPending, now.UnixMilli(), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+// Delivered records a successful attempt
+func (t WebhookTable) Delivered(id int64, responseCode int) error {
+	defer t.writer.observe(deliveryTable, "delivered", time.Now())
+	return t.writer.Do(func(tx *sql.Tx) error {
+		_, err := tx.Stmt(t.delivered).Exec(DeliveryDelivered, responseCode, id)
+		return err
+	})
+}
+
+// Failed records a failed attempt, the delivery is retried at next unless dead is set
+func (t WebhookTable) Failed(id int64, responseCode int, reason string, next time.Time, dead bool) error {
+	defer t.writer.observe(deliveryTable, "failed", time.Now())
+	status := DeliveryPending
+	if dead {
+		status = DeliveryDead
+	}
+	return t.writer.Do(func(tx *sql.Tx) error {
+		_, err := tx.Stmt(t.failed).Exec(status, responseCode, reason, next.UnixMilli(), id)
+		return err
+	})
+}
+
+// Retry queues a dead delivery again with a fresh attempt count
+func (t WebhookTable) Retry(id int64) (found bool, err error) {
+	err = t.writer.Do(func(tx *sql.Tx) error {
+		found, err = rowsAffected(tx.Exec("UPDATE "+deliveryTable+" SET status = ?, attempts = 0, next_attempt = ? WHERE id = ? AND status = ?",
+			DeliveryPending, time.Now().UnixMilli(), id, DeliveryDead))
+		return err
+	})
+	return found, err
+}
+
+// Deliveries returns the delivery log, newest first
+func (t WebhookTable) Deliveries(q DeliveryQuery) ([]Delivery, error) {
+	defer t.writer.observe(deliveryTable, "query", time.Now())
+	sqlQuery := "SELECT " + deliveryFields + " FROM " + deliveryTable + " d JOIN " + webhookTable + " h ON h.id = d.webhook_id WHERE 1 = 1"
+	args := []interface{}{}
+	if q.WebhookID > 0 {
+		sqlQuery += " AND d.webhook_id = ?"
+		args = append(args, q.WebhookID)
+	}
+	if q.Status != "" {
+		sqlQuery += " AND d.status = ?"
+		args = append(args, q.Status)
+	}
+	sqlQuery += " ORDER BY d.id DESC"
+	if q.Limit > 0 {
+		sqlQuery += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+	rows, err := t.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+func (t WebhookTable) close() {
+	_ = t.insert.Close()
+	_ = t.remove.Close()
+	_ = t.active.Close()
+	_ = t.enqueue.Close()
+	_ = t.due.Close()
+	_ = t.delivered.Close()
+	_ = t.failed.Close()
+}
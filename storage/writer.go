@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const writeQueueSize = 256
+
+var ErrWriterClosed = errors.New("storage: writer is closed")
+
+// QueryObserver receives the latency of each storage call by table and operation,
+// writes include the time spent waiting in the queue
+type QueryObserver func(table string, op string, d time.Duration)
+
+type writeRequest struct {
+	fn     func(tx *sql.Tx) error
+	result chan error
+}
+
+// Writer serializes all inserts through one goroutine so concurrent
+// requests queue in process instead of contending for the sqlite lock
+type Writer struct {
+	db     *sql.DB
+	queue  chan writeRequest
+	closed chan struct{}
+	done   chan struct{}
+	// observer lives on the writer because every table already shares it
+	observer atomic.Pointer[QueryObserver]
+}
+
+func NewWriter(db *sql.DB) *Writer {
+	w := &Writer{
+		db:     db,
+		queue:  make(chan writeRequest, writeQueueSize),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+	for {
+		select {
+		case req := <-w.queue:
+			req.result <- w.exec(req.fn)
+		case <-w.closed:
+			// drain anything queued before Close was called
+			for {
+				select {
+				case req := <-w.queue:
+					req.result <- w.exec(req.fn)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *Writer) exec(fn func(tx *sql.Tx) error) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Do runs fn inside a write transaction and waits for it to commit
+func (w *Writer) Do(fn func(tx *sql.Tx) error) error {
+	req := writeRequest{fn: fn, result: make(chan error, 1)}
+	select {
+	case <-w.closed:
+		return ErrWriterClosed
+	case w.queue <- req:
+	}
+	select {
+	case err := <-req.result:
+		return err
+	case <-w.done:
+		// the run loop may exit between our enqueue and its final drain
+		select {
+		case err := <-req.result:
+			return err
+		default:
+			return ErrWriterClosed
+		}
+	}
+}
+
+func (w *Writer) SetObserver(fn QueryObserver) {
+	w.observer.Store(&fn)
+}
+
+// observe is deferred by table methods with the time the call started
+func (w *Writer) observe(table, op string, start time.Time) {
+	if fn := w.observer.Load(); fn != nil && *fn != nil {
+		(*fn)(table, op, time.Since(start))
+	}
+}
+
+// Close stops accepting writes and waits for queued writes to finish
+func (w *Writer) Close() {
+	select {
+	case <-w.closed:
+	default:
+		close(w.closed)
+	}
+	<-w.done
+}